@@ -13,11 +13,13 @@ import (
 
 // App struct
 type App struct {
-	ctx            context.Context
-	authService    *services.AuthService
-	projectService *services.ProjectService
-	imageService   *services.ImageService
-	scheduler      *services.Scheduler
+	ctx             context.Context
+	authService     *services.AuthService
+	projectService  *services.ProjectService
+	imageService    *services.ImageService
+	settingsService *services.SettingsService
+	scheduleService *services.ScheduleService
+	scheduler       *services.Scheduler
 }
 
 // NewApp creates a new App application struct
@@ -40,7 +42,15 @@ func (a *App) startup(ctx context.Context) {
 	a.authService = services.NewAuthService(db)
 	a.projectService = services.NewProjectService(db)
 	a.imageService = services.NewImageService(db)
-	a.scheduler = services.NewScheduler(a.imageService)
+	a.settingsService = services.NewSettingsService(db)
+	a.scheduleService = services.NewScheduleService(db, a.imageService)
+
+	// NewScheduler runs at least one worker, whatever the setting says
+	workers, err := a.settingsService.GetWorkerCount()
+	if err != nil {
+		fmt.Printf("Note: Could not read worker count, using one worker: %v\n", err)
+	}
+	a.scheduler = services.NewScheduler(a.imageService, a.scheduleService, workers)
 
 	// Create default admin user kalau tak exist
 	err = a.authService.CreateUser("admin", "admin123")
@@ -79,18 +89,70 @@ func (a *App) DeleteProject(id int64) error {
 	return a.projectService.DeleteProject(id)
 }
 
-func (a *App) CreateImageTask(projectID int64, imagePath string, targetWidth, targetHeight int, scheduledFor string) (*models.ImageTask, error) {
+func (a *App) CreateImageTask(projectID int64, imagePath string, targetWidth, targetHeight int, scheduledFor string, options models.TaskOptions) (*models.ImageTask, error) {
 	scheduledTime, err := time.Parse(time.RFC3339, scheduledFor)
 	if err != nil {
 		return nil, fmt.Errorf("invalid scheduled time format: %w", err)
 	}
-	return a.imageService.CreateImageTask(projectID, imagePath, targetWidth, targetHeight, scheduledTime)
+	return a.imageService.CreateImageTask(projectID, imagePath, targetWidth, targetHeight, scheduledTime, options)
 }
 
 func (a *App) GetProjectTasks(projectID int64) ([]models.ImageTask, error) {
 	return a.imageService.GetProjectTasks(projectID)
 }
 
+func (a *App) GetTaskOutputs(taskID int64) ([]models.TaskOutput, error) {
+	return a.imageService.GetTaskOutputs(taskID)
+}
+
+func (a *App) RetryTask(taskID int64) error {
+	return a.imageService.RetryTask(taskID)
+}
+
+func (a *App) CancelTask(taskID int64) error {
+	return a.imageService.CancelTask(taskID)
+}
+
+func (a *App) PauseTask(taskID int64) error {
+	return a.imageService.PauseTask(taskID)
+}
+
+func (a *App) ResumeTask(taskID int64) error {
+	return a.imageService.ResumeTask(taskID)
+}
+
+func (a *App) RescheduleTask(taskID int64, scheduledFor string) error {
+	scheduledTime, err := time.Parse(time.RFC3339, scheduledFor)
+	if err != nil {
+		return fmt.Errorf("invalid scheduled time format: %w", err)
+	}
+	return a.imageService.RescheduleTask(taskID, scheduledTime)
+}
+
+func (a *App) UpdateTask(taskID int64, targetWidth, targetHeight int, options models.TaskOptions) (*models.ImageTask, error) {
+	return a.imageService.UpdateTask(taskID, targetWidth, targetHeight, options)
+}
+
+func (a *App) CreateSchedule(projectID int64, name, cronExpr, timezone string, targetWidth, targetHeight int, options models.TaskOptions) (*models.Schedule, error) {
+	return a.scheduleService.CreateSchedule(projectID, name, cronExpr, timezone, targetWidth, targetHeight, options)
+}
+
+func (a *App) ListSchedules(projectID int64) ([]models.Schedule, error) {
+	return a.scheduleService.ListSchedules(projectID)
+}
+
+func (a *App) PauseSchedule(id int64) error {
+	return a.scheduleService.PauseSchedule(id)
+}
+
+func (a *App) ResumeSchedule(id int64) error {
+	return a.scheduleService.ResumeSchedule(id)
+}
+
+func (a *App) DeleteSchedule(id int64) error {
+	return a.scheduleService.DeleteSchedule(id)
+}
+
 func (a *App) SaveUploadedFile(projectID int64, fileData []byte, fileName string) (string, error) {
 	return a.imageService.SaveUploadedFile(projectID, fileData, fileName)
 }
@@ -99,8 +161,40 @@ func (a *App) GetImageData(filePath string) (string, error) {
 	return a.imageService.GetImageData(filePath)
 }
 
-func (a *App) GetResizedImageData(filePath string) (string, error) {
-	return a.imageService.GetResizedImageData(filePath)
+func (a *App) GetResizedImageData(taskID int64) (string, error) {
+	return a.imageService.GetResizedImageData(taskID)
+}
+
+func (a *App) GetLimits() (*models.Limits, error) {
+	return a.settingsService.GetLimits()
+}
+
+func (a *App) UpdateLimits(limits *models.Limits) error {
+	return a.settingsService.UpdateLimits(limits)
+}
+
+func (a *App) GetWorkerProcess() (bool, error) {
+	return a.settingsService.GetWorkerProcess()
+}
+
+func (a *App) UpdateWorkerProcess(enabled bool) error {
+	return a.settingsService.UpdateWorkerProcess(enabled)
+}
+
+func (a *App) GetWorkerCount() (int, error) {
+	return a.settingsService.GetWorkerCount()
+}
+
+func (a *App) UpdateWorkerCount(workers int) error {
+	return a.settingsService.UpdateWorkerCount(workers)
+}
+
+func (a *App) GetOrphanPolicy() (string, error) {
+	return a.settingsService.GetOrphanPolicy()
+}
+
+func (a *App) UpdateOrphanPolicy(policy string) error {
+	return a.settingsService.UpdateOrphanPolicy(policy)
 }
 
 func (a *App) MessageDialog(title string, message string, dialogType string) bool {
@@ -3,26 +3,66 @@
 import {models} from '../models';
 import {services} from '../models';
 
-export function CreateImageTask(arg1:number,arg2:string,arg3:number,arg4:number,arg5:string):Promise<models.ImageTask>;
+export function CancelTask(arg1:number):Promise<void>;
+
+export function CreateImageTask(arg1:number,arg2:string,arg3:number,arg4:number,arg5:string,arg6:models.TaskOptions):Promise<models.ImageTask>;
 
 export function CreateProject(arg1:string,arg2:string):Promise<models.Project>;
 
+export function CreateSchedule(arg1:number,arg2:string,arg3:string,arg4:string,arg5:number,arg6:number,arg7:models.TaskOptions):Promise<models.Schedule>;
+
 export function DeleteProject(arg1:number):Promise<void>;
 
+export function DeleteSchedule(arg1:number):Promise<void>;
+
 export function GetImageData(arg1:string):Promise<string>;
 
+export function GetLimits():Promise<models.Limits>;
+
+export function GetOrphanPolicy():Promise<string>;
+
 export function GetProject(arg1:number):Promise<models.Project>;
 
 export function GetProjectTasks(arg1:number):Promise<Array<models.ImageTask>>;
 
-export function GetResizedImageData(arg1:string):Promise<string>;
+export function GetResizedImageData(arg1:number):Promise<string>;
+
+export function GetTaskOutputs(arg1:number):Promise<Array<models.TaskOutput>>;
+
+export function GetWorkerCount():Promise<number>;
+
+export function GetWorkerProcess():Promise<boolean>;
 
 export function ListProjects():Promise<Array<models.Project>>;
 
+export function ListSchedules(arg1:number):Promise<Array<models.Schedule>>;
+
 export function Login(arg1:string,arg2:string):Promise<services.LoginResponse>;
 
 export function MessageDialog(arg1:string,arg2:string,arg3:string):Promise<boolean>;
 
+export function PauseSchedule(arg1:number):Promise<void>;
+
+export function PauseTask(arg1:number):Promise<void>;
+
+export function RescheduleTask(arg1:number,arg2:string):Promise<void>;
+
+export function ResumeSchedule(arg1:number):Promise<void>;
+
+export function ResumeTask(arg1:number):Promise<void>;
+
+export function RetryTask(arg1:number):Promise<void>;
+
 export function SaveUploadedFile(arg1:number,arg2:Array<number>,arg3:string):Promise<string>;
 
+export function UpdateLimits(arg1:models.Limits):Promise<void>;
+
+export function UpdateOrphanPolicy(arg1:string):Promise<void>;
+
 export function UpdateProject(arg1:models.Project):Promise<void>;
+
+export function UpdateTask(arg1:number,arg2:number,arg3:number,arg4:models.TaskOptions):Promise<models.ImageTask>;
+
+export function UpdateWorkerCount(arg1:number):Promise<void>;
+
+export function UpdateWorkerProcess(arg1:boolean):Promise<void>;
@@ -2,22 +2,42 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
-export function CreateImageTask(arg1, arg2, arg3, arg4, arg5) {
-  return window['go']['main']['App']['CreateImageTask'](arg1, arg2, arg3, arg4, arg5);
+export function CancelTask(arg1) {
+  return window['go']['main']['App']['CancelTask'](arg1);
+}
+
+export function CreateImageTask(arg1, arg2, arg3, arg4, arg5, arg6) {
+  return window['go']['main']['App']['CreateImageTask'](arg1, arg2, arg3, arg4, arg5, arg6);
 }
 
 export function CreateProject(arg1, arg2) {
   return window['go']['main']['App']['CreateProject'](arg1, arg2);
 }
 
+export function CreateSchedule(arg1, arg2, arg3, arg4, arg5, arg6, arg7) {
+  return window['go']['main']['App']['CreateSchedule'](arg1, arg2, arg3, arg4, arg5, arg6, arg7);
+}
+
 export function DeleteProject(arg1) {
   return window['go']['main']['App']['DeleteProject'](arg1);
 }
 
+export function DeleteSchedule(arg1) {
+  return window['go']['main']['App']['DeleteSchedule'](arg1);
+}
+
 export function GetImageData(arg1) {
   return window['go']['main']['App']['GetImageData'](arg1);
 }
 
+export function GetLimits() {
+  return window['go']['main']['App']['GetLimits']();
+}
+
+export function GetOrphanPolicy() {
+  return window['go']['main']['App']['GetOrphanPolicy']();
+}
+
 export function GetProject(arg1) {
   return window['go']['main']['App']['GetProject'](arg1);
 }
@@ -30,10 +50,26 @@ export function GetResizedImageData(arg1) {
   return window['go']['main']['App']['GetResizedImageData'](arg1);
 }
 
+export function GetTaskOutputs(arg1) {
+  return window['go']['main']['App']['GetTaskOutputs'](arg1);
+}
+
+export function GetWorkerCount() {
+  return window['go']['main']['App']['GetWorkerCount']();
+}
+
+export function GetWorkerProcess() {
+  return window['go']['main']['App']['GetWorkerProcess']();
+}
+
 export function ListProjects() {
   return window['go']['main']['App']['ListProjects']();
 }
 
+export function ListSchedules(arg1) {
+  return window['go']['main']['App']['ListSchedules'](arg1);
+}
+
 export function Login(arg1, arg2) {
   return window['go']['main']['App']['Login'](arg1, arg2);
 }
@@ -42,10 +78,54 @@ export function MessageDialog(arg1, arg2, arg3) {
   return window['go']['main']['App']['MessageDialog'](arg1, arg2, arg3);
 }
 
+export function PauseSchedule(arg1) {
+  return window['go']['main']['App']['PauseSchedule'](arg1);
+}
+
+export function PauseTask(arg1) {
+  return window['go']['main']['App']['PauseTask'](arg1);
+}
+
+export function RescheduleTask(arg1, arg2) {
+  return window['go']['main']['App']['RescheduleTask'](arg1, arg2);
+}
+
+export function ResumeSchedule(arg1) {
+  return window['go']['main']['App']['ResumeSchedule'](arg1);
+}
+
+export function ResumeTask(arg1) {
+  return window['go']['main']['App']['ResumeTask'](arg1);
+}
+
+export function RetryTask(arg1) {
+  return window['go']['main']['App']['RetryTask'](arg1);
+}
+
 export function SaveUploadedFile(arg1, arg2, arg3) {
   return window['go']['main']['App']['SaveUploadedFile'](arg1, arg2, arg3);
 }
 
+export function UpdateLimits(arg1) {
+  return window['go']['main']['App']['UpdateLimits'](arg1);
+}
+
+export function UpdateOrphanPolicy(arg1) {
+  return window['go']['main']['App']['UpdateOrphanPolicy'](arg1);
+}
+
 export function UpdateProject(arg1) {
   return window['go']['main']['App']['UpdateProject'](arg1);
 }
+
+export function UpdateTask(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['UpdateTask'](arg1, arg2, arg3, arg4);
+}
+
+export function UpdateWorkerCount(arg1) {
+  return window['go']['main']['App']['UpdateWorkerCount'](arg1);
+}
+
+export function UpdateWorkerProcess(arg1) {
+  return window['go']['main']['App']['UpdateWorkerProcess'](arg1);
+}
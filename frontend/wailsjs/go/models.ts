@@ -1,5 +1,67 @@
 export namespace models {
 	
+	export class Rendition {
+	    width: number;
+	    height: number;
+	    format: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new Rendition(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.width = source["width"];
+	        this.height = source["height"];
+	        this.format = source["format"];
+	    }
+	}
+	export class TaskEvent {
+	    id: number;
+	    task_id: number;
+	    from: string;
+	    to: string;
+	    actor: string;
+	    message: string;
+	    // Go type: time
+	    created_at: any;
+	    // Go type: time
+	    retry_at: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new TaskEvent(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.task_id = source["task_id"];
+	        this.from = source["from"];
+	        this.to = source["to"];
+	        this.actor = source["actor"];
+	        this.message = source["message"];
+	        this.created_at = this.convertValues(source["created_at"], null);
+	        this.retry_at = this.convertValues(source["retry_at"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
 	export class ImageTask {
 	    id: number;
 	    project_id: number;
@@ -11,6 +73,39 @@ export namespace models {
 	    created_at: any;
 	    // Go type: time
 	    scheduled_for: any;
+	    format: string;
+	    source_width: number;
+	    source_height: number;
+	    output_path: string;
+	    output_width: number;
+	    output_height: number;
+	    output_size: number;
+	    last_error: string;
+	    error_stack: string;
+	    claimed_by: string;
+	    // Go type: time
+	    lease_expires: any;
+	    color_space: string;
+	    attempt_count: number;
+	    // Go type: time
+	    next_attempt_at: any;
+	    schedule_id: number;
+	    events: TaskEvent[];
+	    wait_seconds: number;
+	    processing_seconds: number;
+	    resize_mode: string;
+	    gravity: string;
+	    background: string;
+	    output_format: string;
+	    max_bytes: number;
+	    renditions: Rendition[];
+	    color_profile: string;
+	    resampler: string;
+	    linear_light: boolean;
+	    jpeg_quality: number;
+	    png_compression: string;
+	    webp_quality: number;
+	    webp_mode: string;
 	
 	    static createFrom(source: any = {}) {
 	        return new ImageTask(source);
@@ -26,6 +121,37 @@ export namespace models {
 	        this.status = source["status"];
 	        this.created_at = this.convertValues(source["created_at"], null);
 	        this.scheduled_for = this.convertValues(source["scheduled_for"], null);
+	        this.format = source["format"];
+	        this.source_width = source["source_width"];
+	        this.source_height = source["source_height"];
+	        this.output_path = source["output_path"];
+	        this.output_width = source["output_width"];
+	        this.output_height = source["output_height"];
+	        this.output_size = source["output_size"];
+	        this.last_error = source["last_error"];
+	        this.error_stack = source["error_stack"];
+	        this.claimed_by = source["claimed_by"];
+	        this.lease_expires = this.convertValues(source["lease_expires"], null);
+	        this.color_space = source["color_space"];
+	        this.attempt_count = source["attempt_count"];
+	        this.next_attempt_at = this.convertValues(source["next_attempt_at"], null);
+	        this.schedule_id = source["schedule_id"];
+	        this.events = this.convertValues(source["events"], TaskEvent);
+	        this.wait_seconds = source["wait_seconds"];
+	        this.processing_seconds = source["processing_seconds"];
+	        this.resize_mode = source["resize_mode"];
+	        this.gravity = source["gravity"];
+	        this.background = source["background"];
+	        this.output_format = source["output_format"];
+	        this.max_bytes = source["max_bytes"];
+	        this.renditions = this.convertValues(source["renditions"], Rendition);
+	        this.color_profile = source["color_profile"];
+	        this.resampler = source["resampler"];
+	        this.linear_light = source["linear_light"];
+	        this.jpeg_quality = source["jpeg_quality"];
+	        this.png_compression = source["png_compression"];
+	        this.webp_quality = source["webp_quality"];
+	        this.webp_mode = source["webp_mode"];
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
@@ -46,6 +172,22 @@ export namespace models {
 		    return a;
 		}
 	}
+	export class Limits {
+	    max_pixels: number;
+	    max_file_size: number;
+	    max_task_memory: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new Limits(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.max_pixels = source["max_pixels"];
+	        this.max_file_size = source["max_file_size"];
+	        this.max_task_memory = source["max_task_memory"];
+	    }
+	}
 	export class Project {
 	    id: number;
 	    name: string;
@@ -53,6 +195,14 @@ export namespace models {
 	    // Go type: time
 	    creation_time: any;
 	    location: string;
+	    metadata_policy: string;
+	    jpeg_quality: number;
+	    png_compression: string;
+	    webp_quality: number;
+	    webp_mode: string;
+	    max_attempts: number;
+	    retry_delay: number;
+	    max_retry_delay: number;
 	
 	    static createFrom(source: any = {}) {
 	        return new Project(source);
@@ -65,6 +215,171 @@ export namespace models {
 	        this.description = source["description"];
 	        this.creation_time = this.convertValues(source["creation_time"], null);
 	        this.location = source["location"];
+	        this.metadata_policy = source["metadata_policy"];
+	        this.jpeg_quality = source["jpeg_quality"];
+	        this.png_compression = source["png_compression"];
+	        this.webp_quality = source["webp_quality"];
+	        this.webp_mode = source["webp_mode"];
+	        this.max_attempts = source["max_attempts"];
+	        this.retry_delay = source["retry_delay"];
+	        this.max_retry_delay = source["max_retry_delay"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	export class TaskOptions {
+	    resize_mode: string;
+	    gravity: string;
+	    background: string;
+	    output_format: string;
+	    max_bytes: number;
+	    renditions: Rendition[];
+	    color_profile: string;
+	    resampler: string;
+	    linear_light: boolean;
+	    jpeg_quality: number;
+	    png_compression: string;
+	    webp_quality: number;
+	    webp_mode: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new TaskOptions(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.resize_mode = source["resize_mode"];
+	        this.gravity = source["gravity"];
+	        this.background = source["background"];
+	        this.output_format = source["output_format"];
+	        this.max_bytes = source["max_bytes"];
+	        this.renditions = this.convertValues(source["renditions"], Rendition);
+	        this.color_profile = source["color_profile"];
+	        this.resampler = source["resampler"];
+	        this.linear_light = source["linear_light"];
+	        this.jpeg_quality = source["jpeg_quality"];
+	        this.png_compression = source["png_compression"];
+	        this.webp_quality = source["webp_quality"];
+	        this.webp_mode = source["webp_mode"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class Schedule {
+	    id: number;
+	    project_id: number;
+	    name: string;
+	    cron_expr: string;
+	    timezone: string;
+	    target_width: number;
+	    target_height: number;
+	    options: TaskOptions;
+	    paused: boolean;
+	    // Go type: time
+	    created_at: any;
+	    // Go type: time
+	    last_run_at: any;
+	    // Go type: time
+	    next_run_at: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new Schedule(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.project_id = source["project_id"];
+	        this.name = source["name"];
+	        this.cron_expr = source["cron_expr"];
+	        this.timezone = source["timezone"];
+	        this.target_width = source["target_width"];
+	        this.target_height = source["target_height"];
+	        this.options = this.convertValues(source["options"], TaskOptions);
+	        this.paused = source["paused"];
+	        this.created_at = this.convertValues(source["created_at"], null);
+	        this.last_run_at = this.convertValues(source["last_run_at"], null);
+	        this.next_run_at = this.convertValues(source["next_run_at"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	
+	
+	export class TaskOutput {
+	    id: number;
+	    task_id: number;
+	    path: string;
+	    format: string;
+	    width: number;
+	    height: number;
+	    size: number;
+	    // Go type: time
+	    created_at: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new TaskOutput(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.task_id = source["task_id"];
+	        this.path = source["path"];
+	        this.format = source["format"];
+	        this.width = source["width"];
+	        this.height = source["height"];
+	        this.size = source["size"];
+	        this.created_at = this.convertValues(source["created_at"], null);
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
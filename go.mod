@@ -4,9 +4,10 @@ go 1.21
 
 require (
 	github.com/mattn/go-sqlite3 v1.14.24
-	github.com/nfnt/resize v0.0.0-20180221191011-83c6a9932646
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/wailsapp/wails/v2 v2.9.2
 	golang.org/x/crypto v0.23.0
+	golang.org/x/image v0.18.0
 )
 
 require (
@@ -35,7 +36,7 @@ require (
 	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sys v0.20.0 // indirect
-	golang.org/x/text v0.15.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
 
 // replace github.com/wailsapp/wails/v2 v2.9.2 => /Users/syedizzuddin/go/pkg/mod
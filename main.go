@@ -2,6 +2,10 @@ package main
 
 import (
 	"embed"
+	"log"
+	"os"
+
+	"resizer/services"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
@@ -12,6 +16,14 @@ import (
 var assets embed.FS
 
 func main() {
+	// Run as an image processing worker when the scheduler starts one
+	if len(os.Args) > 1 && os.Args[1] == services.WorkerArg {
+		if err := services.RunWorker(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Create an instance of the app structure
 	app := NewApp()
 
@@ -25,6 +37,7 @@ func main() {
 		},
 		BackgroundColour: &options.RGBA{R: 27, G: 38, B: 54, A: 1},
 		OnStartup:        app.startup,
+		OnShutdown:       app.shutdown,
 		Bind: []interface{}{
 			app,
 		},
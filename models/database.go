@@ -15,17 +15,221 @@ type Project struct {
 	Description  string    `json:"description"`
 	CreationTime time.Time `json:"creation_time"`
 	Location     string    `json:"location"`
+	// MetadataPolicy decides what happens to EXIF, XMP, IPTC and comments
+	// when the project's images are processed
+	MetadataPolicy string `json:"metadata_policy"`
+	EncoderSettings
+	RetryPolicy
+}
+
+// RetryPolicy decides how a project's tasks are retried after a failure
+// that may go away by itself, such as a locked file or a full disk. Zero
+// values mean "not set".
+type RetryPolicy struct {
+	MaxAttempts   int `json:"max_attempts"`    // runs allowed per task, including the first
+	RetryDelay    int `json:"retry_delay"`     // seconds before the first retry, doubling after each
+	MaxRetryDelay int `json:"max_retry_delay"` // seconds the delay stops doubling at
+}
+
+// Metadata policies
+const (
+	MetadataKeep         = "keep"          // copy all metadata to the outputs
+	MetadataStrip        = "strip"         // drop all metadata
+	MetadataStripPrivate = "strip_private" // drop GPS, serial numbers and owner names only
+)
+
+// TaskStatus is where a task is in its life. Tasks only move between
+// statuses along the transitions services allow, each one recorded as a
+// TaskEvent.
+type TaskStatus string
+
+// Task statuses
+const (
+	TaskPending    TaskStatus = "pending"    // waiting for its scheduled time or a worker
+	TaskPaused     TaskStatus = "paused"     // held back until resumed
+	TaskProcessing TaskStatus = "processing" // claimed by an app instance and running
+	TaskCompleted  TaskStatus = "completed"
+	TaskFailed     TaskStatus = "failed"
+	TaskCancelled  TaskStatus = "cancelled"
+)
+
+// What happens to tasks left processing by an app that quit or crashed
+const (
+	OrphanRequeue = "requeue" // run the task again
+	OrphanFail    = "fail"    // mark the task failed
+)
+
+// Resize modes
+const (
+	ResizeExact  = "exact"  // stretch to the target size
+	ResizeFit    = "fit"    // fit inside the target size, keeping the aspect ratio
+	ResizeCover  = "cover"  // fill the target size, cropping the overflow
+	ResizePad    = "pad"    // fit inside, then pad to the target size
+	ResizeWidth  = "width"  // match the target width, keeping the aspect ratio
+	ResizeHeight = "height" // match the target height, keeping the aspect ratio
+)
+
+// Crop and pad anchors
+const (
+	GravityCenter    = "center"
+	GravityNorth     = "north"
+	GravitySouth     = "south"
+	GravityEast      = "east"
+	GravityWest      = "west"
+	GravityNorthEast = "northeast"
+	GravityNorthWest = "northwest"
+	GravitySouthEast = "southeast"
+	GravitySouthWest = "southwest"
+)
+
+// PNG compression levels
+const (
+	PNGCompressionDefault = "default"
+	PNGCompressionNone    = "none"
+	PNGCompressionFast    = "fast"
+	PNGCompressionBest    = "best"
+)
+
+// WebP encoding modes
+const (
+	WebPModeAuto     = "auto" // lossless if the source is lossless WebP
+	WebPModeLossy    = "lossy"
+	WebPModeLossless = "lossless"
+)
+
+// Resamplers
+const (
+	ResamplerNearest    = "nearest" // pixel art
+	ResamplerBox        = "box"     // area average, for large downscales
+	ResamplerBilinear   = "bilinear"
+	ResamplerCatmullRom = "catmull-rom" // sharp bicubic
+	ResamplerMitchell   = "mitchell"    // soft bicubic, little ringing
+	ResamplerLanczos2   = "lanczos2"
+	ResamplerLanczos3   = "lanczos3"
+)
+
+// Colour profile handling
+const (
+	ColorProfileSRGB = "srgb" // convert pixels to sRGB and drop the profile
+	ColorProfileKeep = "keep" // leave pixels alone and embed the source profile
+)
+
+// EncoderSettings control output compression. On a project they are the
+// defaults for new tasks; zero values mean "not set".
+type EncoderSettings struct {
+	JPEGQuality    int    `json:"jpeg_quality"`    // 1-100
+	PNGCompression string `json:"png_compression"` // default, none, fast or best
+	WebPQuality    int    `json:"webp_quality"`    // 1-100, lossy only
+	WebPMode       string `json:"webp_mode"`       // auto, lossy or lossless
+}
+
+// TaskOptions are the per-task processing settings chosen when a task is
+// created.
+type TaskOptions struct {
+	ResizeMode   string      `json:"resize_mode"`
+	Gravity      string      `json:"gravity"`
+	Background   string      `json:"background"`    // #rrggbb or #rrggbbaa, used by pad
+	OutputFormat string      `json:"output_format"` // empty keeps the source format
+	MaxBytes     int64       `json:"max_bytes"`     // largest allowed output size, 0 for no limit
+	Renditions   []Rendition `json:"renditions"`    // extra outputs besides the target size
+	ColorProfile string      `json:"color_profile"` // srgb or keep
+	Resampler    string      `json:"resampler"`
+	LinearLight  bool        `json:"linear_light"` // resample in linear light rather than sRGB
+	EncoderSettings
+}
+
+// Rendition is an extra output of a task, e.g. one entry of a srcset. Zero
+// width or height follows the task's resize mode, as for the target size.
+type Rendition struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Format string `json:"format"` // empty uses the task's output format
+}
+
+// TaskOutput is a file written by a task.
+type TaskOutput struct {
+	ID        int64     `json:"id"`
+	TaskID    int64     `json:"task_id"`
+	Path      string    `json:"path"`
+	Format    string    `json:"format"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type ImageTask struct {
-	ID           int64     `json:"id"`
-	ProjectID    int64     `json:"project_id"`
-	ImagePath    string    `json:"image_path"`
-	TargetWidth  int       `json:"target_width"`
-	TargetHeight int       `json:"target_height"`
-	Status       string    `json:"status"`
-	CreatedAt    time.Time `json:"created_at"`
-	ScheduledFor time.Time `json:"scheduled_for"`
+	ID           int64      `json:"id"`
+	ProjectID    int64      `json:"project_id"`
+	ImagePath    string     `json:"image_path"`
+	TargetWidth  int        `json:"target_width"`
+	TargetHeight int        `json:"target_height"`
+	Status       TaskStatus `json:"status"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ScheduledFor time.Time  `json:"scheduled_for"`
+	Format       string     `json:"format"`
+	SourceWidth  int        `json:"source_width"`
+	SourceHeight int        `json:"source_height"`
+	OutputPath   string     `json:"output_path"`
+	OutputWidth  int        `json:"output_width"`
+	OutputHeight int        `json:"output_height"`
+	OutputSize   int64      `json:"output_size"`
+	LastError    string     `json:"last_error"`
+	ErrorStack   string     `json:"error_stack"`   // stack trace when the task failed by crashing
+	ClaimedBy    string     `json:"claimed_by"`    // the app instance that claimed the task to process it
+	LeaseExpires time.Time  `json:"lease_expires"` // a processing task's claim lapses after this unless renewed
+	ColorSpace   string     `json:"color_space"`   // source ICC profile name, empty when untagged
+	AttemptCount int        `json:"attempt_count"` // times the task has been claimed to run
+	// NextAttemptAt holds back a pending task being retried after a failure
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+	ScheduleID    int64     `json:"schedule_id"` // the recurring schedule that created the task, 0 if none
+	// Events is the task's status history, oldest first, with the time
+	// spent waiting once due and processing summed over all its runs
+	Events            []TaskEvent `json:"events"`
+	WaitSeconds       float64     `json:"wait_seconds"`
+	ProcessingSeconds float64     `json:"processing_seconds"`
+	TaskOptions
+}
+
+// Schedule creates tasks in a project on a recurring cron schedule. Each
+// run makes a task, with the schedule's settings, for every source image in
+// the project that the schedule hasn't made one for yet.
+type Schedule struct {
+	ID           int64       `json:"id"`
+	ProjectID    int64       `json:"project_id"`
+	Name         string      `json:"name"`
+	CronExpr     string      `json:"cron_expr"` // five fields, e.g. "0 2 * * *", or a descriptor such as @daily
+	Timezone     string      `json:"timezone"`  // IANA name the expression is read in; empty for the app's local time
+	TargetWidth  int         `json:"target_width"`
+	TargetHeight int         `json:"target_height"`
+	Options      TaskOptions `json:"options"`
+	Paused       bool        `json:"paused"`
+	CreatedAt    time.Time   `json:"created_at"`
+	LastRunAt    time.Time   `json:"last_run_at"`
+	NextRunAt    time.Time   `json:"next_run_at"`
+}
+
+// TaskEvent records a task moving from one status to another.
+type TaskEvent struct {
+	ID        int64      `json:"id"`
+	TaskID    int64      `json:"task_id"`
+	From      TaskStatus `json:"from"` // empty when the task was created
+	To        TaskStatus `json:"to"`
+	Actor     string     `json:"actor"` // "user", or the app instance that made the change
+	Message   string     `json:"message"`
+	CreatedAt time.Time  `json:"created_at"`
+	// RetryAt is when a task put back to pending after a failed attempt
+	// may run again; zero for other events
+	RetryAt time.Time `json:"retry_at"`
+}
+
+// Limits protect the app from images that would exhaust memory, such as
+// decompression bombs: small files that claim enormous dimensions. Zero
+// turns a limit off.
+type Limits struct {
+	MaxPixels     int64 `json:"max_pixels"`      // width x height of the source
+	MaxFileSize   int64 `json:"max_file_size"`   // bytes
+	MaxTaskMemory int64 `json:"max_task_memory"` // estimated bytes held while processing one task
 }
 
 type User struct {
@@ -49,24 +253,16 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		}
 	}
 
-	// Open the database connection
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL")
+	// Open the database connection. The busy timeout and foreign keys are
+	// per connection, so they go in the DSN to cover every pooled connection
+	// the scheduler's workers use, not just the first. Transactions take the
+	// write lock up front, so one that reads a task's status before changing
+	// it waits its turn instead of failing when another writer got in first
+	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Set busy timeout to handle concurrent access
-	_, err = db.Exec("PRAGMA busy_timeout = 5000")
-	if err != nil {
-		return nil, fmt.Errorf("failed to set busy timeout: %w", err)
-	}
-
-	// Enable foreign keys
-	_, err = db.Exec("PRAGMA foreign_keys = ON")
-	if err != nil {
-		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
-	}
-
 	// Create users table
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS users (
@@ -111,5 +307,182 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create image_tasks table: %w", err)
 	}
 
+	// Create task_outputs table
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS task_outputs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			task_id INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			format TEXT NOT NULL,
+			width INTEGER NOT NULL,
+			height INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (task_id) REFERENCES image_tasks (id)
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create task_outputs table: %w", err)
+	}
+
+	// Create schedules table, for recurring tasks
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS schedules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			project_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			cron_expr TEXT NOT NULL,
+			timezone TEXT NOT NULL,
+			target_width INTEGER NOT NULL,
+			target_height INTEGER NOT NULL,
+			options TEXT NOT NULL,
+			paused INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME NOT NULL,
+			last_run_at INTEGER NOT NULL DEFAULT 0,
+			next_run_at INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (project_id) REFERENCES projects (id)
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schedules table: %w", err)
+	}
+
+	// Create task_events table, the status history of each task
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS task_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			task_id INTEGER NOT NULL,
+			from_status TEXT NOT NULL,
+			to_status TEXT NOT NULL,
+			actor TEXT NOT NULL,
+			message TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (task_id) REFERENCES image_tasks (id)
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create task_events table: %w", err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS task_events_task_id ON task_events (task_id)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create task_events index: %w", err)
+	}
+
+	// Create settings table, for app-wide settings such as resource limits
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create settings table: %w", err)
+	}
+
+	// Add columns introduced after the tables were first created
+	for _, column := range projectColumns {
+		if err := ensureColumn(db, "projects", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+	for _, column := range imageTaskColumns {
+		if err := ensureColumn(db, "image_tasks", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+	for _, column := range taskEventColumns {
+		if err := ensureColumn(db, "task_events", column.name, column.definition); err != nil {
+			return nil, err
+		}
+	}
+
 	return db, nil
 }
+
+// columnDef is a column added after the initial schema. InitDB adds any that
+// are missing so older databases keep working.
+type columnDef struct {
+	name       string
+	definition string
+}
+
+var projectColumns = []columnDef{
+	{"jpeg_quality", "INTEGER NOT NULL DEFAULT 0"},
+	{"png_compression", "TEXT NOT NULL DEFAULT ''"},
+	{"webp_quality", "INTEGER NOT NULL DEFAULT 0"},
+	{"webp_mode", "TEXT NOT NULL DEFAULT ''"},
+	{"metadata_policy", "TEXT NOT NULL DEFAULT 'keep'"},
+	{"max_attempts", "INTEGER NOT NULL DEFAULT 3"},
+	{"retry_delay", "INTEGER NOT NULL DEFAULT 30"},       // seconds
+	{"max_retry_delay", "INTEGER NOT NULL DEFAULT 3600"}, // seconds
+}
+
+var imageTaskColumns = []columnDef{
+	{"format", "TEXT NOT NULL DEFAULT ''"},
+	{"source_width", "INTEGER NOT NULL DEFAULT 0"},
+	{"source_height", "INTEGER NOT NULL DEFAULT 0"},
+	{"resize_mode", "TEXT NOT NULL DEFAULT 'exact'"},
+	{"gravity", "TEXT NOT NULL DEFAULT 'center'"},
+	{"background", "TEXT NOT NULL DEFAULT '#ffffff'"},
+	{"output_format", "TEXT NOT NULL DEFAULT ''"},
+	{"output_path", "TEXT NOT NULL DEFAULT ''"},
+	{"jpeg_quality", "INTEGER NOT NULL DEFAULT 75"},
+	{"png_compression", "TEXT NOT NULL DEFAULT 'default'"},
+	{"webp_quality", "INTEGER NOT NULL DEFAULT 75"},
+	{"webp_mode", "TEXT NOT NULL DEFAULT 'auto'"},
+	{"max_bytes", "INTEGER NOT NULL DEFAULT 0"},
+	{"output_width", "INTEGER NOT NULL DEFAULT 0"},
+	{"output_height", "INTEGER NOT NULL DEFAULT 0"},
+	{"output_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"last_error", "TEXT NOT NULL DEFAULT ''"},
+	{"renditions", "TEXT NOT NULL DEFAULT ''"},
+	{"color_profile", "TEXT NOT NULL DEFAULT 'srgb'"},
+	{"color_space", "TEXT NOT NULL DEFAULT ''"},
+	{"resampler", "TEXT NOT NULL DEFAULT 'lanczos3'"},
+	{"linear_light", "INTEGER NOT NULL DEFAULT 0"},
+	{"error_stack", "TEXT NOT NULL DEFAULT ''"},
+	{"claimed_by", "TEXT NOT NULL DEFAULT ''"},
+	{"lease_expires", "INTEGER NOT NULL DEFAULT 0"}, // Unix seconds
+	{"attempt_count", "INTEGER NOT NULL DEFAULT 0"},
+	{"next_attempt_at", "INTEGER NOT NULL DEFAULT 0"}, // Unix seconds
+	{"schedule_id", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+var taskEventColumns = []columnDef{
+	{"retry_at", "INTEGER NOT NULL DEFAULT 0"}, // Unix seconds
+}
+
+// ensureColumn adds a column to table unless it already exists.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read %s columns: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return fmt.Errorf("failed to scan %s columns: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s columns: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// This file splits image files into their container-level pieces (JPEG
+// marker segments, PNG chunks and WebP RIFF chunks) so metadata can be read
+// without decoding pixels. The readers are lenient: they stop at the first
+// malformed piece and return what they found so far.
+
+// jpegSegment is a marker segment from the header of a JPEG file. data
+// excludes the marker and length bytes.
+type jpegSegment struct {
+	marker byte
+	data   []byte
+}
+
+const (
+	jpegMarkerSOI   = 0xd8
+	jpegMarkerSOS   = 0xda
+	jpegMarkerAPP1  = 0xe1
+	jpegMarkerAPP2  = 0xe2
+	jpegMarkerAPP13 = 0xed
+	jpegMarkerCOM   = 0xfe
+)
+
+// readJPEGSegments returns the segments between SOI and the first SOS.
+func readJPEGSegments(data []byte) []jpegSegment {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegMarkerSOI {
+		return nil
+	}
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xff {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte
+			pos++
+			continue
+		}
+		if marker == jpegMarkerSOS {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if n < 2 || pos+2+n > len(data) {
+			break
+		}
+		segments = append(segments, jpegSegment{marker: marker, data: data[pos+4 : pos+2+n]})
+		pos += 2 + n
+	}
+	return segments
+}
+
+// pngChunk is a chunk from a PNG file, without its length and CRC.
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// readPNGChunks returns every chunk up to and including IEND.
+func readPNGChunks(data []byte) []pngChunk {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil
+	}
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		if n < 0 || pos+12+n > len(data) {
+			break
+		}
+		chunk := pngChunk{typ: string(data[pos+4 : pos+8]), data: data[pos+8 : pos+8+n]}
+		chunks = append(chunks, chunk)
+		pos += 12 + n
+		if chunk.typ == "IEND" {
+			break
+		}
+	}
+	return chunks
+}
+
+// riffChunk is a chunk from a WebP file, without its header and padding.
+type riffChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// readWebPChunks returns the chunks inside a WebP file's RIFF container.
+func readWebPChunks(data []byte) []riffChunk {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+	var chunks []riffChunk
+	pos := 12
+	for pos+8 <= len(data) {
+		n := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if n < 0 || pos+8+n > len(data) {
+			break
+		}
+		chunks = append(chunks, riffChunk{fourCC: string(data[pos : pos+4]), data: data[pos+8 : pos+8+n]})
+		pos += 8 + n + n&1
+	}
+	return chunks
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"resizer/models"
+)
+
+var (
+	errTaskCancelled = errors.New("task was cancelled")
+	errClaimLost     = errors.New("task was taken over by another app instance")
+)
+
+// trackRunning remembers how to cancel a task this instance is processing.
+func (i *ImageService) trackRunning(taskID int64, cancel context.CancelFunc) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.running[taskID] = cancel
+}
+
+func (i *ImageService) untrackRunning(taskID int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.running, taskID)
+}
+
+// CancelTask cancels a task that hasn't finished. A task being processed
+// stops straight away if this app instance is processing it, or when its
+// lease is next renewed if another instance is.
+func (i *ImageService) CancelTask(taskID int64) error {
+	previous, err := i.transitionTask(taskID, taskChange{
+		action:  "cancel",
+		from:    []models.TaskStatus{models.TaskPending, models.TaskPaused, models.TaskProcessing},
+		to:      models.TaskCancelled,
+		set:     "next_attempt_at = 0",
+		actor:   actorUser,
+		message: "cancelled",
+	})
+	if err != nil {
+		return err
+	}
+
+	if previous == models.TaskProcessing {
+		i.mu.Lock()
+		cancel := i.running[taskID]
+		i.mu.Unlock()
+		if cancel != nil {
+			cancel()
+		}
+	}
+	return nil
+}
+
+// PauseTask holds back a pending task until ResumeTask.
+func (i *ImageService) PauseTask(taskID int64) error {
+	_, err := i.transitionTask(taskID, taskChange{
+		action:  "pause",
+		from:    []models.TaskStatus{models.TaskPending},
+		to:      models.TaskPaused,
+		actor:   actorUser,
+		message: "paused",
+	})
+	return err
+}
+
+// ResumeTask puts a paused task back in the queue. It runs at its scheduled
+// time, or straight away if that has passed.
+func (i *ImageService) ResumeTask(taskID int64) error {
+	_, err := i.transitionTask(taskID, taskChange{
+		action:  "resume",
+		from:    []models.TaskStatus{models.TaskPaused},
+		to:      models.TaskPending,
+		actor:   actorUser,
+		message: "resumed",
+	})
+	return err
+}
+
+// RescheduleTask moves a task that isn't running or completed to a new
+// time, with a fresh set of attempts. Failed and cancelled tasks are queued
+// again; paused tasks stay paused.
+func (i *ImageService) RescheduleTask(taskID int64, scheduledFor time.Time) error {
+	_, err := i.transitionTask(taskID, taskChange{
+		action:  "reschedule",
+		from:    []models.TaskStatus{models.TaskPending, models.TaskPaused, models.TaskFailed, models.TaskCancelled},
+		to:      models.TaskPending,
+		stay:    []models.TaskStatus{models.TaskPaused},
+		set:     "scheduled_for = ?, attempt_count = 0, next_attempt_at = 0, last_error = '', error_stack = ''",
+		setArgs: []interface{}{scheduledFor},
+		actor:   actorUser,
+		message: "rescheduled for " + scheduledFor.Format("2006-01-02 15:04:05 MST"),
+	})
+	return err
+}
+
+// UpdateTask changes the target size and options of a task that isn't
+// running or completed, filling in unset options as CreateImageTask does.
+func (i *ImageService) UpdateTask(taskID int64, targetWidth, targetHeight int, opts models.TaskOptions) (*models.ImageTask, error) {
+	var projectID int64
+	err := i.db.QueryRow("SELECT project_id FROM image_tasks WHERE id = ?", taskID).Scan(&projectID)
+	if err == sql.ErrNoRows {
+		return nil, errTaskNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task: %w", err)
+	}
+
+	if err := i.resolveTaskOptions(projectID, &opts, targetWidth, targetHeight); err != nil {
+		return nil, err
+	}
+	renditions, err := json.Marshal(opts.Renditions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode renditions: %w", err)
+	}
+
+	task := &models.ImageTask{}
+	err = scanTask(i.db.QueryRow(`
+		UPDATE image_tasks
+		SET target_width = ?, target_height = ?, resize_mode = ?, gravity = ?, background = ?, output_format = ?,
+			jpeg_quality = ?, png_compression = ?, webp_quality = ?, webp_mode = ?, max_bytes = ?, renditions = ?,
+			color_profile = ?, resampler = ?, linear_light = ?
+		WHERE id = ? AND status IN (?, ?, ?, ?)
+		RETURNING `+taskColumns,
+		targetWidth, targetHeight, opts.ResizeMode, opts.Gravity, opts.Background, opts.OutputFormat,
+		opts.JPEGQuality, opts.PNGCompression, opts.WebPQuality, opts.WebPMode, opts.MaxBytes, string(renditions),
+		opts.ColorProfile, opts.Resampler, opts.LinearLight, taskID,
+		models.TaskPending, models.TaskPaused, models.TaskFailed, models.TaskCancelled), task)
+	if err == sql.ErrNoRows {
+		// The status changed since the task was read
+		status, err := i.taskStatus(taskID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &transitionError{action: "edit", status: status}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update task: %w", err)
+	}
+	return task, nil
+}
+
+// taskStatus returns the current status of a task.
+func (i *ImageService) taskStatus(taskID int64) (models.TaskStatus, error) {
+	var status models.TaskStatus
+	err := i.db.QueryRow("SELECT status FROM image_tasks WHERE id = ?", taskID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", errTaskNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get task: %w", err)
+	}
+	return status, nil
+}
+
+// abandonTask handles a run cut short before it completed the task. A
+// cancelled task has its partial outputs removed; one still claimed by this
+// instance, because the caller's context ended, goes back to pending.
+func (i *ImageService) abandonTask(task *models.ImageTask) error {
+	var status models.TaskStatus
+	var claimedBy string
+	err := i.db.QueryRow("SELECT status, claimed_by FROM image_tasks WHERE id = ?", task.ID).Scan(&status, &claimedBy)
+	if err != nil {
+		return fmt.Errorf("failed to get task status: %w", err)
+	}
+
+	switch {
+	case status == models.TaskCancelled:
+		log.Printf("Task %d was cancelled", task.ID)
+		if err := i.removePartialOutputs(task); err != nil {
+			return err
+		}
+		return errTaskCancelled
+	case status == models.TaskProcessing && claimedBy == i.owner:
+		log.Printf("Task %d was interrupted, requeueing it", task.ID)
+		if err := i.removePartialOutputs(task); err != nil {
+			return err
+		}
+		_, err := i.transitionTask(task.ID, taskChange{
+			action:    "requeue",
+			from:      []models.TaskStatus{models.TaskProcessing},
+			to:        models.TaskPending,
+			set:       "claimed_by = '', lease_expires = 0",
+			where:     "claimed_by = ?",
+			whereArgs: []interface{}{i.owner},
+			actor:     i.owner,
+			message:   "interrupted, requeued",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to requeue task: %w", err)
+		}
+		return context.Canceled
+	}
+	log.Printf("Task %d is now %s, claimed by %s, leaving it", task.ID, status, claimedBy)
+	return errClaimLost
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"resizer/models"
+)
+
+// defaultEncoderSettings are used for anything neither the task nor its
+// project sets. They match what the encoders did before settings existed.
+var defaultEncoderSettings = models.EncoderSettings{
+	JPEGQuality:    jpeg.DefaultQuality,
+	PNGCompression: models.PNGCompressionDefault,
+	WebPQuality:    webpDefaultQuality,
+	WebPMode:       models.WebPModeAuto,
+}
+
+// withDefaults fills the unset fields of s from defaults.
+func withDefaults(s, defaults models.EncoderSettings) models.EncoderSettings {
+	if s.JPEGQuality == 0 {
+		s.JPEGQuality = defaults.JPEGQuality
+	}
+	if s.PNGCompression == "" {
+		s.PNGCompression = defaults.PNGCompression
+	}
+	if s.WebPQuality == 0 {
+		s.WebPQuality = defaults.WebPQuality
+	}
+	if s.WebPMode == "" {
+		s.WebPMode = defaults.WebPMode
+	}
+	return s
+}
+
+// validateEncoderSettings checks the fields that are set.
+func validateEncoderSettings(s models.EncoderSettings) error {
+	if s.JPEGQuality < 0 || s.JPEGQuality > 100 {
+		return fmt.Errorf("JPEG quality must be between 1 and 100")
+	}
+	if s.WebPQuality < 0 || s.WebPQuality > 100 {
+		return fmt.Errorf("WebP quality must be between 1 and 100")
+	}
+	if _, err := pngCompressionLevel(s.PNGCompression); err != nil {
+		return err
+	}
+	switch s.WebPMode {
+	case "", models.WebPModeAuto, models.WebPModeLossy, models.WebPModeLossless:
+	default:
+		return fmt.Errorf("unknown WebP mode %q", s.WebPMode)
+	}
+	return nil
+}
+
+func pngCompressionLevel(level string) (png.CompressionLevel, error) {
+	switch level {
+	case "", models.PNGCompressionDefault:
+		return png.DefaultCompression, nil
+	case models.PNGCompressionNone:
+		return png.NoCompression, nil
+	case models.PNGCompressionFast:
+		return png.BestSpeed, nil
+	case models.PNGCompressionBest:
+		return png.BestCompression, nil
+	}
+	return 0, fmt.Errorf("unknown PNG compression %q", level)
+}
+
+// encodeImage writes a still image, or anim when it is set, in the given
+// format. sourceLossless tells the auto WebP mode whether the source was
+// lossless WebP.
+func encodeImage(w io.Writer, img image.Image, anim *gif.GIF, format *imageFormat, settings models.EncoderSettings, sourceLossless bool) error {
+	settings = withDefaults(settings, defaultEncoderSettings)
+
+	switch format.Name {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: settings.JPEGQuality})
+	case "png":
+		level, err := pngCompressionLevel(settings.PNGCompression)
+		if err != nil {
+			return err
+		}
+		enc := &png.Encoder{CompressionLevel: level}
+		return enc.Encode(w, img)
+	case "gif":
+		if anim != nil {
+			return gif.EncodeAll(w, anim)
+		}
+		return gif.Encode(w, img, nil)
+	case "webp":
+		lossless := settings.WebPMode == models.WebPModeLossless ||
+			(settings.WebPMode == models.WebPModeAuto && sourceLossless)
+		return encodeWebP(w, img, &webpOptions{Lossless: lossless, Quality: settings.WebPQuality})
+	}
+	return fmt.Errorf("unsupported output format %q", format.Name)
+}
@@ -0,0 +1,355 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// EXIF orientation values (TIFF tag 0x0112)
+const (
+	orientationNormal     = 1
+	orientationFlipH      = 2
+	orientationRotate180  = 3
+	orientationFlipV      = 4
+	orientationTranspose  = 5
+	orientationRotate90   = 6 // rotate 90 degrees clockwise to display
+	orientationTransverse = 7
+	orientationRotate270  = 8 // rotate 90 degrees anticlockwise to display
+)
+
+const exifTagOrientation = 0x0112
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// findEXIF returns the TIFF-structured EXIF data embedded in a JPEG (APP1),
+// PNG (eXIf) or WebP (EXIF) file, or nil if there is none.
+func findEXIF(data []byte, format *imageFormat) []byte {
+	switch format.Name {
+	case "jpeg":
+		for _, seg := range readJPEGSegments(data) {
+			if seg.marker == jpegMarkerAPP1 && bytes.HasPrefix(seg.data, exifHeader) {
+				return seg.data[len(exifHeader):]
+			}
+		}
+	case "png":
+		for _, chunk := range readPNGChunks(data) {
+			if chunk.typ == "eXIf" {
+				return chunk.data
+			}
+		}
+	case "webp":
+		for _, chunk := range readWebPChunks(data) {
+			if chunk.fourCC == "EXIF" {
+				// Some writers keep the JPEG-style prefix
+				return bytes.TrimPrefix(chunk.data, exifHeader)
+			}
+		}
+	}
+	return nil
+}
+
+// tiffByteOrder returns the byte order of TIFF data, or nil if the header is
+// not valid.
+func tiffByteOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		return binary.LittleEndian
+	case "MM\x00*":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// exifOrientation reads the orientation tag from IFD0, returning
+// orientationNormal if it is missing or invalid.
+func exifOrientation(tiff []byte) int {
+	order := tiffByteOrder(tiff)
+	if order == nil {
+		return orientationNormal
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return orientationNormal
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == exifTagOrientation {
+			v := int(order.Uint16(tiff[entry+8:]))
+			if v >= orientationNormal && v <= orientationRotate270 {
+				return v
+			}
+			break
+		}
+	}
+	return orientationNormal
+}
+
+// orientedSize returns the displayed size of a w x h image.
+func orientedSize(w, h, orientation int) (int, int) {
+	if orientation >= orientationTranspose {
+		return h, w
+	}
+	return w, h
+}
+
+// applyOrientation rotates and flips img so it displays upright without the
+// orientation tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= orientationNormal || orientation > orientationRotate270 {
+		return img
+	}
+
+	b := img.Bounds()
+	src, ok := img.(*image.NRGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := orientedSize(w, h, orientation)
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case orientationFlipH:
+				dx, dy = w-1-x, y
+			case orientationRotate180:
+				dx, dy = w-1-x, h-1-y
+			case orientationFlipV:
+				dx, dy = x, h-1-y
+			case orientationTranspose:
+				dx, dy = y, x
+			case orientationRotate90:
+				dx, dy = h-1-y, x
+			case orientationTransverse:
+				dx, dy = h-1-y, w-1-x
+			case orientationRotate270:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+4*dx:dy*dst.Stride+4*dx+4], row[4*x:4*x+4])
+		}
+	}
+	return dst
+}
+
+// EXIF tags touched when copying metadata to an output
+const (
+	exifTagExifIFD            = 0x8769
+	exifTagGPSIFD             = 0x8825
+	exifTagInteropIFD         = 0xa005
+	exifTagPixelXDimension    = 0xa002
+	exifTagPixelYDimension    = 0xa003
+	exifTagMakerNote          = 0x927c
+	exifTagCameraOwnerName    = 0xa430
+	exifTagBodySerialNumber   = 0xa431
+	exifTagLensSerialNumber   = 0xa435
+	exifTagCameraSerialNumber = 0xc62f
+)
+
+// exifPrivateTags identify the photographer or their device. MakerNote is
+// vendor data that usually carries the body serial number too.
+var exifPrivateTags = map[uint16]bool{
+	exifTagGPSIFD:             true,
+	exifTagMakerNote:          true,
+	exifTagCameraOwnerName:    true,
+	exifTagBodySerialNumber:   true,
+	exifTagLensSerialNumber:   true,
+	exifTagCameraSerialNumber: true,
+}
+
+// exifTypeSizes is the byte size of each TIFF field type.
+var exifTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// exifData is TIFF-structured EXIF data edited in place. Offsets inside it
+// never move, so removed values are zeroed rather than cut out.
+type exifData struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// exifEntry is one 12-byte IFD entry.
+type exifEntry struct {
+	pos   int // offset of the entry
+	tag   uint16
+	typ   uint16
+	count int
+	value int // offset of the value, inside the entry when it fits in 4 bytes
+	size  int
+}
+
+// parseEXIF copies tiff so it can be edited.
+func parseEXIF(tiff []byte) (*exifData, error) {
+	order := tiffByteOrder(tiff)
+	if order == nil {
+		return nil, fmt.Errorf("invalid EXIF header")
+	}
+	return &exifData{b: append([]byte(nil), tiff...), order: order}, nil
+}
+
+// entries reads the entries of the IFD at off.
+func (e *exifData) entries(off int) ([]exifEntry, error) {
+	if off < 8 || off+2 > len(e.b) {
+		return nil, fmt.Errorf("EXIF directory out of range")
+	}
+	n := int(e.order.Uint16(e.b[off:]))
+	if off+2+12*n+4 > len(e.b) {
+		return nil, fmt.Errorf("EXIF directory out of range")
+	}
+	entries := make([]exifEntry, n)
+	for i := range entries {
+		pos := off + 2 + 12*i
+		ent := exifEntry{
+			pos:   pos,
+			tag:   e.order.Uint16(e.b[pos:]),
+			typ:   e.order.Uint16(e.b[pos+2:]),
+			count: int(e.order.Uint32(e.b[pos+4:])),
+			value: pos + 8,
+		}
+		ent.size = exifTypeSizes[ent.typ] * ent.count
+		if ent.count < 0 || ent.size < 0 {
+			return nil, fmt.Errorf("invalid EXIF entry %#04x", ent.tag)
+		}
+		if ent.size > 4 {
+			ent.value = int(e.order.Uint32(e.b[pos+8:]))
+			if ent.value < 8 || ent.value+ent.size > len(e.b) || ent.value+ent.size < ent.value {
+				return nil, fmt.Errorf("EXIF value for tag %#04x out of range", ent.tag)
+			}
+		}
+		entries[i] = ent
+	}
+	return entries, nil
+}
+
+// directories returns the offsets of IFD0, the Exif, GPS and interop
+// sub-directories, and any further IFDs in the chain (IFD1 holds the
+// thumbnail).
+func (e *exifData) directories() ([]int, error) {
+	var dirs []int
+	seen := make(map[int]bool)
+	queue := []int{int(e.order.Uint32(e.b[4:]))}
+	for len(queue) > 0 {
+		off := queue[0]
+		queue = queue[1:]
+		if off == 0 || seen[off] {
+			continue
+		}
+		seen[off] = true
+		entries, err := e.entries(off)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, off)
+		for _, ent := range entries {
+			switch ent.tag {
+			case exifTagExifIFD, exifTagGPSIFD, exifTagInteropIFD:
+				queue = append(queue, int(e.order.Uint32(e.b[ent.pos+8:])))
+			}
+		}
+		next := off + 2 + 12*len(entries)
+		queue = append(queue, int(e.order.Uint32(e.b[next:])))
+	}
+	return dirs, nil
+}
+
+// removeTags deletes every entry whose tag is in tags, zeroing its value.
+// Removing a sub-directory pointer zeroes the whole sub-directory.
+func (e *exifData) removeTags(tags map[uint16]bool) error {
+	dirs, err := e.directories()
+	if err != nil {
+		return err
+	}
+	for _, off := range dirs {
+		entries, err := e.entries(off)
+		if err != nil {
+			// Already zeroed through a removed pointer
+			continue
+		}
+		kept := entries[:0]
+		for _, ent := range entries {
+			if !tags[ent.tag] {
+				kept = append(kept, ent)
+				continue
+			}
+			if ent.tag == exifTagGPSIFD || ent.tag == exifTagExifIFD || ent.tag == exifTagInteropIFD {
+				e.zeroDirectory(int(e.order.Uint32(e.b[ent.pos+8:])))
+			}
+			clear(e.b[ent.value : ent.value+max(ent.size, 4)])
+		}
+		e.rewriteDirectory(off, entries, kept)
+	}
+	return nil
+}
+
+// rewriteDirectory packs the kept entries of the IFD at off to the front,
+// followed by the next-IFD offset, and zeroes the bytes left over.
+func (e *exifData) rewriteDirectory(off int, entries, kept []exifEntry) {
+	if len(kept) == len(entries) {
+		return
+	}
+	end := off + 2 + 12*len(entries)
+	next := append([]byte(nil), e.b[end:end+4]...)
+	packed := make([]byte, 0, 12*len(kept)+4)
+	for _, ent := range kept {
+		packed = append(packed, e.b[ent.pos:ent.pos+12]...)
+	}
+	packed = append(packed, next...)
+	clear(e.b[off+2 : end+4])
+	copy(e.b[off+2:], packed)
+	e.order.PutUint16(e.b[off:], uint16(len(kept)))
+}
+
+// zeroDirectory wipes the IFD at off and its out-of-line values.
+func (e *exifData) zeroDirectory(off int) {
+	entries, err := e.entries(off)
+	if err != nil {
+		return
+	}
+	for _, ent := range entries {
+		if ent.size > 4 {
+			clear(e.b[ent.value : ent.value+ent.size])
+		}
+	}
+	clear(e.b[off : off+2+12*len(entries)+4])
+}
+
+// setInt overwrites a single SHORT or LONG value wherever tag appears.
+// Tags that are missing are not added.
+func (e *exifData) setInt(tag uint16, v int) error {
+	dirs, err := e.directories()
+	if err != nil {
+		return err
+	}
+	for _, off := range dirs {
+		entries, err := e.entries(off)
+		if err != nil {
+			return err
+		}
+		for _, ent := range entries {
+			if ent.tag != tag || ent.count != 1 {
+				continue
+			}
+			switch ent.typ {
+			case 3:
+				e.order.PutUint16(e.b[ent.value:], uint16(v))
+			case 4:
+				e.order.PutUint32(e.b[ent.value:], uint32(v))
+			}
+		}
+	}
+	return nil
+}
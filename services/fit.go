@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+
+	"resizer/models"
+)
+
+const (
+	// fitMinQuality is the lowest quality the size search uses before it
+	// starts shrinking the image instead.
+	fitMinQuality = 30
+	// fitMaxShrinks limits how many times the image is made smaller.
+	fitMaxShrinks = 8
+	// fitMinDimension is the smallest width or height the search will go to.
+	fitMinDimension = 16
+)
+
+// fitToSize encodes src so the output is at most maxBytes. At each size it
+// lowers the quality (JPEG and lossy WebP) as little as needed, down to
+// fitMinQuality; if that is not enough it shrinks the image and tries
+// again. Each size is rendered once and only re-encoded while the quality
+// is searched. It returns the encoded data with the plan and settings that
+// produced it, or ctx's error between attempts once ctx is cancelled.
+func fitToSize(ctx context.Context, src *decodedImage, plan resizePlan, format *imageFormat, settings models.EncoderSettings, maxBytes int64) ([]byte, resizePlan, models.EncoderSettings, error) {
+	settings = withDefaults(settings, defaultEncoderSettings)
+	if format.Name == "png" {
+		settings.PNGCompression = models.PNGCompressionBest
+	}
+
+	initial := settings
+	for shrinks := 0; ; shrinks++ {
+		// Every size starts again from the requested quality
+		settings = initial
+		img, anim := src.render(ctx, plan, format)
+		if err := ctx.Err(); err != nil {
+			return nil, plan, settings, err
+		}
+		data, err := src.encodeRendered(img, anim, plan, format, settings)
+		if err != nil {
+			return nil, plan, settings, fmt.Errorf("failed to encode resized image: %w", err)
+		}
+		if int64(len(data)) <= maxBytes {
+			return data, plan, settings, nil
+		}
+
+		if quality := qualitySetting(&settings, format, src.lossless); quality != nil && *quality > fitMinQuality {
+			// Binary search for the highest quality that fits
+			var best []byte
+			lo, hi := fitMinQuality, *quality-1
+			for lo <= hi {
+				if err := ctx.Err(); err != nil {
+					return nil, plan, settings, err
+				}
+				mid := (lo + hi) / 2
+				*quality = mid
+				attempt, err := src.encodeRendered(img, anim, plan, format, settings)
+				if err != nil {
+					return nil, plan, settings, fmt.Errorf("failed to encode resized image: %w", err)
+				}
+				if int64(len(attempt)) <= maxBytes {
+					best, lo = attempt, mid+1
+				} else {
+					data, hi = attempt, mid-1
+				}
+			}
+			if best != nil {
+				*quality = lo - 1
+				return best, plan, settings, nil
+			}
+		}
+
+		// Shrink by roughly the square root of the overshoot, since size
+		// tracks pixel count
+		factor := math.Sqrt(float64(maxBytes)/float64(len(data))) * 0.95
+		factor = math.Max(0.5, math.Min(0.9, factor))
+		next := plan.scaledBy(factor)
+		if shrinks == fitMaxShrinks || next.canvas.X < fitMinDimension || next.canvas.Y < fitMinDimension {
+			return nil, plan, settings, fmt.Errorf("cannot fit %s output under %d bytes: smallest attempt was %d bytes at %dx%d",
+				format.Name, maxBytes, len(data), plan.canvas.X, plan.canvas.Y)
+		}
+		plan = next
+	}
+}
+
+// qualitySetting returns the quality field the search can lower for format,
+// or nil for lossless output.
+func qualitySetting(settings *models.EncoderSettings, format *imageFormat, sourceLossless bool) *int {
+	switch format.Name {
+	case "jpeg":
+		return &settings.JPEGQuality
+	case "webp":
+		if settings.WebPMode == models.WebPModeLossy || (settings.WebPMode == models.WebPModeAuto && !sourceLossless) {
+			return &settings.WebPQuality
+		}
+	}
+	return nil
+}
+
+// scaledBy returns the plan with its output scaled by factor, keeping the
+// same crop.
+func (p resizePlan) scaledBy(factor float64) resizePlan {
+	p.scaled = image.Pt(scaleDim(p.scaled.X, factor), scaleDim(p.scaled.Y, factor))
+	p.canvas = image.Pt(scaleDim(p.canvas.X, factor), scaleDim(p.canvas.Y, factor))
+	p.offset = image.Pt(
+		min(int(float64(p.offset.X)*factor+0.5), p.canvas.X-p.scaled.X),
+		min(int(float64(p.offset.Y)*factor+0.5), p.canvas.Y-p.scaled.Y),
+	)
+	return p
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/webp"
+)
+
+// imageFormat describes an image format the service can read and write.
+type imageFormat struct {
+	Name         string
+	Extensions   []string // the first one is used for new files
+	MIMEType     string
+	Alpha        bool // whether the format can store (partial) transparency
+	magic        func(header []byte) bool
+	decodeConfig func(io.Reader) (image.Config, error)
+}
+
+// imageFormats is the format registry. Formats are detected from their magic
+// bytes, never from the file name.
+var imageFormats = []*imageFormat{
+	{
+		Name:         "jpeg",
+		Extensions:   []string{".jpg", ".jpeg"},
+		MIMEType:     "image/jpeg",
+		magic:        func(h []byte) bool { return bytes.HasPrefix(h, []byte("\xff\xd8\xff")) },
+		decodeConfig: jpeg.DecodeConfig,
+	},
+	{
+		Name:         "png",
+		Extensions:   []string{".png"},
+		MIMEType:     "image/png",
+		Alpha:        true,
+		magic:        func(h []byte) bool { return bytes.HasPrefix(h, []byte("\x89PNG\r\n\x1a\n")) },
+		decodeConfig: png.DecodeConfig,
+	},
+	{
+		Name:       "gif",
+		Extensions: []string{".gif"},
+		MIMEType:   "image/gif",
+		magic: func(h []byte) bool {
+			return bytes.HasPrefix(h, []byte("GIF87a")) || bytes.HasPrefix(h, []byte("GIF89a"))
+		},
+		decodeConfig: gif.DecodeConfig,
+	},
+	{
+		Name:       "webp",
+		Extensions: []string{".webp"},
+		MIMEType:   "image/webp",
+		Alpha:      true,
+		magic: func(h []byte) bool {
+			return len(h) >= 12 && string(h[:4]) == "RIFF" && string(h[8:12]) == "WEBP"
+		},
+		decodeConfig: webp.DecodeConfig,
+	},
+}
+
+// sniffLen is the number of leading bytes needed to recognise any format.
+const sniffLen = 12
+
+// formatByName returns the registered format called name, or nil.
+func formatByName(name string) *imageFormat {
+	for _, f := range imageFormats {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// outputPath returns the resized file path for a source image: the source
+// name plus suffix in the project's resized folder, with this format's
+// extension.
+func (f *imageFormat) outputPath(sourcePath, suffix string) string {
+	dir := filepath.Join(filepath.Dir(filepath.Dir(sourcePath)), "resized")
+	base := strings.TrimSuffix(filepath.Base(sourcePath), filepath.Ext(sourcePath))
+	return filepath.Join(dir, base+suffix+f.Extensions[0])
+}
+
+// matchesExtension reports whether ext (in any case) belongs to the format.
+func (f *imageFormat) matchesExtension(ext string) bool {
+	ext = strings.ToLower(ext)
+	for _, e := range f.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// detectFormat identifies an image from its leading bytes.
+func detectFormat(header []byte) (*imageFormat, error) {
+	for _, f := range imageFormats {
+		if f.magic(header) {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported image format")
+}
+
+// inspectImage detects the format of an image and returns its displayed
+// pixel dimensions without decoding the pixels. Width and height are swapped
+// when the EXIF orientation rotates the image by 90 degrees.
+func inspectImage(data []byte) (*imageFormat, image.Config, error) {
+	format, err := detectFormat(data[:min(len(data), sniffLen)])
+	if err != nil {
+		return nil, image.Config{}, err
+	}
+	cfg, err := format.decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, image.Config{}, fmt.Errorf("failed to read %s header: %w", format.Name, err)
+	}
+	cfg.Width, cfg.Height = orientedSize(cfg.Width, cfg.Height, exifOrientation(findEXIF(data, format)))
+	return format, cfg, nil
+}
+
+// inspectImageFile is inspectImage for a file on disk.
+func inspectImageFile(path string) (*imageFormat, image.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, image.Config{}, fmt.Errorf("failed to open image: %w", err)
+	}
+	return inspectImage(data)
+}
+
+// checkExtension returns an error if fileName's extension does not belong to
+// the detected format, e.g. a PNG saved as "photo.jpg".
+func checkExtension(fileName string, format *imageFormat) error {
+	ext := filepath.Ext(fileName)
+	if !format.matchesExtension(ext) {
+		return fmt.Errorf("%s is a %s image but has a %q extension; expected %s",
+			filepath.Base(fileName), strings.ToUpper(format.Name), ext, strings.Join(format.Extensions, " or "))
+	}
+	return nil
+}
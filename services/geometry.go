@@ -0,0 +1,260 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+
+	"resizer/models"
+)
+
+const defaultBackground = "#ffffff"
+
+// resizePlan describes how a source image maps onto the output: which part of
+// the source is used, the size it is scaled to, and where it sits on the
+// output canvas.
+type resizePlan struct {
+	crop       image.Rectangle // region of the source that is kept
+	scaled     image.Point     // size the crop is resized to
+	canvas     image.Point     // output size
+	offset     image.Point     // position of the scaled image on the canvas
+	background color.NRGBA     // fill for the padded area
+	resampler  Resampler       // kernel used to scale the crop
+	resample   ResampleOptions
+}
+
+// padded reports whether the canvas is larger than the scaled image.
+func (p resizePlan) padded() bool {
+	return p.canvas != p.scaled
+}
+
+// normalizeTaskOptions fills in defaults and validates the task settings
+// against the target size.
+func normalizeTaskOptions(opts *models.TaskOptions, targetWidth, targetHeight int) error {
+	if opts.ResizeMode == "" {
+		opts.ResizeMode = models.ResizeExact
+	}
+	if opts.Gravity == "" {
+		opts.Gravity = models.GravityCenter
+	}
+	if opts.Background == "" {
+		opts.Background = defaultBackground
+	}
+	if opts.ColorProfile == "" {
+		opts.ColorProfile = models.ColorProfileSRGB
+	}
+	if opts.Resampler == "" {
+		opts.Resampler = models.ResamplerLanczos3
+	}
+	if err := checkTargetSize(opts.ResizeMode, targetWidth, targetHeight); err != nil {
+		return err
+	}
+	// Renditions are named by size and format, so two alike would write
+	// the same file
+	seen := make(map[models.Rendition]bool)
+	for _, r := range opts.Renditions {
+		if err := checkTargetSize(opts.ResizeMode, r.Width, r.Height); err != nil {
+			return fmt.Errorf("rendition %dx%d: %w", r.Width, r.Height, err)
+		}
+		if r.Format != "" && formatByName(r.Format) == nil {
+			return fmt.Errorf("unsupported rendition format %q", r.Format)
+		}
+		key := models.Rendition{Width: r.Width, Height: r.Height}
+		if format := formatByName(firstNonEmpty(r.Format, opts.OutputFormat)); format != nil {
+			key.Format = format.Name
+		}
+		if seen[key] {
+			return fmt.Errorf("rendition %dx%d is listed more than once", r.Width, r.Height)
+		}
+		seen[key] = true
+	}
+
+	if _, _, err := gravityAnchor(opts.Gravity); err != nil {
+		return err
+	}
+	if _, err := parseColor(opts.Background); err != nil {
+		return err
+	}
+	if opts.OutputFormat != "" && formatByName(opts.OutputFormat) == nil {
+		return fmt.Errorf("unsupported output format %q", opts.OutputFormat)
+	}
+	if opts.ColorProfile != models.ColorProfileSRGB && opts.ColorProfile != models.ColorProfileKeep {
+		return fmt.Errorf("unknown colour profile handling %q", opts.ColorProfile)
+	}
+	if resamplerByName(opts.Resampler) == nil {
+		return fmt.Errorf("unknown resampler %q", opts.Resampler)
+	}
+	return validateEncoderSettings(opts.EncoderSettings)
+}
+
+// checkTargetSize checks that a target size suits the resize mode.
+func checkTargetSize(mode string, targetWidth, targetHeight int) error {
+	if targetWidth < 0 || targetHeight < 0 {
+		return fmt.Errorf("target size cannot be negative")
+	}
+
+	switch mode {
+	case models.ResizeExact, models.ResizeFit:
+		if targetWidth == 0 && targetHeight == 0 {
+			return fmt.Errorf("%s resize needs a target width or height", mode)
+		}
+	case models.ResizeCover, models.ResizePad:
+		if targetWidth == 0 || targetHeight == 0 {
+			return fmt.Errorf("%s resize needs both a target width and height", mode)
+		}
+	case models.ResizeWidth:
+		if targetWidth == 0 {
+			return fmt.Errorf("width resize needs a target width")
+		}
+	case models.ResizeHeight:
+		if targetHeight == 0 {
+			return fmt.Errorf("height resize needs a target height")
+		}
+	default:
+		return fmt.Errorf("unknown resize mode %q", mode)
+	}
+	return nil
+}
+
+// gravityAnchor returns the horizontal and vertical anchor of a gravity as
+// fractions: 0 is left/top, 1 is right/bottom.
+func gravityAnchor(gravity string) (float64, float64, error) {
+	switch gravity {
+	case models.GravityCenter, "":
+		return 0.5, 0.5, nil
+	case models.GravityNorth:
+		return 0.5, 0, nil
+	case models.GravitySouth:
+		return 0.5, 1, nil
+	case models.GravityEast:
+		return 1, 0.5, nil
+	case models.GravityWest:
+		return 0, 0.5, nil
+	case models.GravityNorthEast:
+		return 1, 0, nil
+	case models.GravityNorthWest:
+		return 0, 0, nil
+	case models.GravitySouthEast:
+		return 1, 1, nil
+	case models.GravitySouthWest:
+		return 0, 1, nil
+	}
+	return 0, 0, fmt.Errorf("unknown gravity %q", gravity)
+}
+
+// parseColor parses #rgb, #rrggbb or #rrggbbaa.
+func parseColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid background colour %q", s)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
+
+// planResize works out the crop, scale and padding for a srcW x srcH image.
+func planResize(srcW, srcH int, task *models.ImageTask) (resizePlan, error) {
+	opts := task.TaskOptions
+	if err := normalizeTaskOptions(&opts, task.TargetWidth, task.TargetHeight); err != nil {
+		return resizePlan{}, err
+	}
+	gx, gy, _ := gravityAnchor(opts.Gravity)
+	bg, _ := parseColor(opts.Background)
+
+	w, h := task.TargetWidth, task.TargetHeight
+	plan := resizePlan{crop: image.Rect(0, 0, srcW, srcH), background: bg, resampler: resamplerByName(opts.Resampler)}
+	plan.resample.LinearLight = opts.LinearLight
+	scaleW := float64(w) / float64(srcW)
+	scaleH := float64(h) / float64(srcH)
+
+	switch opts.ResizeMode {
+	case models.ResizeExact:
+		// A zero dimension keeps the aspect ratio
+		switch {
+		case w == 0:
+			w = scaleDim(srcW, scaleH)
+		case h == 0:
+			h = scaleDim(srcH, scaleW)
+		}
+		plan.scaled = image.Pt(w, h)
+	case models.ResizeWidth:
+		plan.scaled = image.Pt(w, scaleDim(srcH, scaleW))
+	case models.ResizeHeight:
+		plan.scaled = image.Pt(scaleDim(srcW, scaleH), h)
+	case models.ResizeFit, models.ResizePad:
+		scale := scaleW
+		if w == 0 || (h != 0 && scaleH < scaleW) {
+			scale = scaleH
+		}
+		plan.scaled = image.Pt(scaleDim(srcW, scale), scaleDim(srcH, scale))
+	case models.ResizeCover:
+		scale := scaleW
+		if scaleH > scaleW {
+			scale = scaleH
+		}
+		cropW := min(srcW, max(1, int(float64(w)/scale+0.5)))
+		cropH := min(srcH, max(1, int(float64(h)/scale+0.5)))
+		x := int(float64(srcW-cropW)*gx + 0.5)
+		y := int(float64(srcH-cropH)*gy + 0.5)
+		plan.crop = image.Rect(x, y, x+cropW, y+cropH)
+		plan.scaled = image.Pt(w, h)
+	}
+
+	plan.canvas = plan.scaled
+	if opts.ResizeMode == models.ResizePad {
+		plan.canvas = image.Pt(w, h)
+		plan.offset = image.Pt(
+			int(float64(w-plan.scaled.X)*gx+0.5),
+			int(float64(h-plan.scaled.Y)*gy+0.5),
+		)
+	}
+	return plan, nil
+}
+
+// scaleDim scales a dimension, never going below one pixel.
+func scaleDim(v int, scale float64) int {
+	return max(1, int(float64(v)*scale+0.5))
+}
+
+// applyResize crops, scales and pads img according to plan.
+func applyResize(img image.Image, plan resizePlan) image.Image {
+	b := img.Bounds()
+	if crop := plan.crop.Add(b.Min); crop != b {
+		if sub, ok := img.(interface {
+			SubImage(r image.Rectangle) image.Image
+		}); ok {
+			img = sub.SubImage(crop)
+		}
+	}
+
+	resized := plan.resampler.Resize(img, plan.scaled.X, plan.scaled.Y, plan.resample)
+	if !plan.padded() {
+		return resized
+	}
+
+	canvas := image.NewNRGBA(image.Rectangle{Max: plan.canvas})
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{plan.background}, image.Point{}, draw.Src)
+	dst := image.Rectangle{Min: plan.offset, Max: plan.offset.Add(plan.scaled)}
+	draw.Draw(canvas, dst, resized, resized.Bounds().Min, draw.Over)
+	return canvas
+}
+
+// flattenImage composites img onto an opaque background, for output formats
+// that cannot store transparency.
+func flattenImage(img image.Image, background color.NRGBA) image.Image {
+	background.A = 0xff
+	b := img.Bounds()
+	flat := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{background}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+	return flat
+}
@@ -0,0 +1,204 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+)
+
+// resizeGIF applies plan to every frame of an animated GIF. Frames are
+// cropped and scaled in place within the canvas, so frame offsets, delays,
+// disposal methods, the loop count and the background index all carry over.
+// Each frame is mapped back onto its own palette (shared or local), and a
+// frame's transparent index stays transparent.
+func resizeGIF(g *gif.GIF, plan resizePlan) *gif.GIF {
+	out := &gif.GIF{
+		Image:           make([]*image.Paletted, len(g.Image)),
+		Delay:           append([]int(nil), g.Delay...),
+		LoopCount:       g.LoopCount,
+		Disposal:        append([]byte(nil), g.Disposal...),
+		Config:          g.Config,
+		BackgroundIndex: g.BackgroundIndex,
+	}
+	out.Config.Width, out.Config.Height = plan.canvas.X, plan.canvas.Y
+
+	crop := plan.crop
+	mapX := func(x int) int {
+		return plan.offset.X + ((x-crop.Min.X)*plan.scaled.X+crop.Dx()/2)/crop.Dx()
+	}
+	mapY := func(y int) int {
+		return plan.offset.Y + ((y-crop.Min.Y)*plan.scaled.Y+crop.Dy()/2)/crop.Dy()
+	}
+
+	for n, frame := range g.Image {
+		if ctx := plan.resample.Context; ctx != nil && ctx.Err() != nil {
+			break
+		}
+		b := frame.Bounds().Intersect(crop)
+		if b.Empty() {
+			// The frame lies entirely in the cropped-away area
+			out.Image[n] = gifEmptyFrame(frame.Palette, plan.offset)
+			continue
+		}
+
+		r := image.Rect(mapX(b.Min.X), mapY(b.Min.Y), mapX(b.Max.X), mapY(b.Max.Y))
+		if r.Dx() == 0 {
+			r.Max.X = r.Min.X + 1
+		}
+		if r.Dy() == 0 {
+			r.Max.Y = r.Min.Y + 1
+		}
+
+		resized := plan.resampler.Resize(frame.SubImage(b), r.Dx(), r.Dy(), plan.resample)
+		if b == crop && plan.padded() {
+			// Full frames also paint the padding around the image
+			canvas := image.NewNRGBA(image.Rectangle{Max: plan.canvas})
+			draw.Draw(canvas, canvas.Bounds(), &image.Uniform{plan.background}, image.Point{}, draw.Src)
+			draw.Draw(canvas, r, resized, resized.Bounds().Min, draw.Over)
+			resized, r = canvas, canvas.Bounds()
+		}
+		out.Image[n] = gifQuantize(resized, r, frame.Palette)
+	}
+	return out
+}
+
+// gifSize returns the logical screen size of g. Streams without one are
+// sized by their first frame.
+func gifSize(g *gif.GIF) (int, int) {
+	if g.Config.Width > 0 && g.Config.Height > 0 {
+		return g.Config.Width, g.Config.Height
+	}
+	b := g.Image[0].Bounds()
+	return b.Max.X, b.Max.Y
+}
+
+// gifFirstFrame renders the first frame of g on its full canvas, for
+// converting an animation to a still image format.
+func gifFirstFrame(g *gif.GIF) image.Image {
+	w, h := gifSize(g)
+	canvas := image.NewNRGBA(image.Rect(0, 0, w, h))
+	frame := g.Image[0]
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+	return canvas
+}
+
+// gifEmptyFrame returns a single transparent pixel, keeping a frame's delay
+// and disposal when all of its content has been cropped away.
+func gifEmptyFrame(palette color.Palette, at image.Point) *image.Paletted {
+	palette = append(color.Palette(nil), palette...)
+	transparent := -1
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = i
+			break
+		}
+	}
+	if transparent < 0 && len(palette) < 256 {
+		palette = append(palette, color.RGBA{})
+		transparent = len(palette) - 1
+	}
+	frame := image.NewPaletted(image.Rectangle{Min: at, Max: at.Add(image.Pt(1, 1))}, palette)
+	if transparent >= 0 {
+		frame.Pix[0] = uint8(transparent)
+	}
+	return frame
+}
+
+// gifQuantize maps img onto palette, placing the result at rect. Pixels that
+// are mostly transparent use the palette's transparent entry (if any); the
+// rest use the nearest opaque colour.
+func gifQuantize(img image.Image, rect image.Rectangle, palette color.Palette) *image.Paletted {
+	dst := image.NewPaletted(rect, palette)
+
+	transparent := -1
+	for i, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = i
+			break
+		}
+	}
+
+	// Build an opaque-only palette so interpolated colours never snap to the
+	// transparent entry
+	opaque := make(color.Palette, 0, len(palette))
+	indices := make([]uint8, 0, len(palette))
+	for i, c := range palette {
+		if i == transparent {
+			continue
+		}
+		opaque = append(opaque, c)
+		indices = append(indices, uint8(i))
+	}
+
+	cache := make(map[color.NRGBA]uint8)
+	b := img.Bounds()
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			c := color.NRGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			var idx uint8
+			switch {
+			case transparent >= 0 && c.A < 0x80:
+				idx = uint8(transparent)
+			case len(opaque) == 0:
+				idx = 0
+			default:
+				c.A = 0xff
+				var ok bool
+				if idx, ok = cache[c]; !ok {
+					idx = indices[opaque.Index(c)]
+					cache[c] = idx
+				}
+			}
+			dst.Pix[y*dst.Stride+x] = idx
+		}
+	}
+	return dst
+}
+
+// gifFrameCount counts the frames of a GIF stream without decoding them, by
+// walking its blocks.
+func gifFrameCount(data []byte) (int, error) {
+	// Header and logical screen descriptor
+	if len(data) < 13 {
+		return 0, fmt.Errorf("gif: header too short")
+	}
+	pos := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1) // global colour table
+	}
+
+	// skipSubBlocks returns the position after a chain of data sub-blocks
+	skipSubBlocks := func(pos int) int {
+		for pos < len(data) && data[pos] != 0 {
+			pos += int(data[pos]) + 1
+		}
+		return pos + 1
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x2c: // image descriptor
+			if pos+10 > len(data) {
+				return frames, nil
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1) // local colour table
+			}
+			pos = skipSubBlocks(pos + 1) // after the LZW code size
+			frames++
+		case 0x21: // extension
+			pos = skipSubBlocks(pos + 2)
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return 0, fmt.Errorf("gif: unknown block 0x%02x", data[pos])
+		}
+	}
+	// Truncated streams still decode the frames they have
+	return frames, nil
+}
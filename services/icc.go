@@ -0,0 +1,310 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+	"unicode/utf16"
+)
+
+// iccProfile is the part of an ICC profile needed to convert matrix/TRC RGB
+// images, which covers the common camera and phone profiles (Display P3,
+// Adobe RGB, ProPhoto). LUT-based profiles are recognised but not converted.
+type iccProfile struct {
+	colorSpace  string // data colour space from the header, e.g. "RGB", "CMYK", "GRAY"
+	description string
+	hasMatrix   bool
+	matrix      [3][3]float64 // linear RGB to D50 XYZ, one column per channel
+	curves      [3]iccCurve
+}
+
+// iccCurve is a tone reproduction curve: a table, or a parametric function
+// of up to 7 parameters (g, a, b, c, d, e, f).
+type iccCurve struct {
+	table      []float64
+	funcType   int
+	params     [7]float64
+	parametric bool
+}
+
+// srgbToXYZD50 is the colourant matrix of the standard sRGB profile, adapted
+// to the D50 PCS white like every ICC matrix.
+var srgbToXYZD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// parseICC reads the header, description and matrix/TRC tags of a profile.
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("invalid ICC profile")
+	}
+	p := &iccProfile{colorSpace: strings.TrimSpace(string(data[16:20]))}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + 12*i
+		if entry+12 > len(data) {
+			return nil, fmt.Errorf("invalid ICC tag table")
+		}
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 8 || offset+size > len(data) || offset+size < offset {
+			return nil, fmt.Errorf("invalid ICC tag %q", data[entry:entry+4])
+		}
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p.description = iccText(tags["desc"])
+
+	if p.colorSpace != "RGB" {
+		return p, nil
+	}
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, ok := tags[name+"XYZ"]
+		curve, err := parseICCCurve(tags[name+"TRC"])
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " || err != nil {
+			return p, nil
+		}
+		for row := 0; row < 3; row++ {
+			p.matrix[row][c] = s15Fixed16(xyz[8+4*row:])
+		}
+		p.curves[c] = curve
+	}
+	p.hasMatrix = true
+	return p, nil
+}
+
+// name is how the profile is shown to users.
+func (p *iccProfile) name() string {
+	if p.description != "" {
+		return p.description
+	}
+	return p.colorSpace
+}
+
+// iccText decodes a textDescriptionType (ICC v2) or
+// multiLocalizedUnicodeType (ICC v4) tag, taking the first record of the
+// latter.
+func iccText(tag []byte) string {
+	switch {
+	case len(tag) >= 12 && string(tag[:4]) == "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n <= 0 || 12+n > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+	case len(tag) >= 28 && string(tag[:4]) == "mluc":
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if n <= 0 || offset+n > len(tag) {
+			return ""
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+// parseICCCurve reads a curveType or parametricCurveType tag.
+func parseICCCurve(tag []byte) (iccCurve, error) {
+	var c iccCurve
+	switch {
+	case len(tag) >= 12 && string(tag[:4]) == "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+2*n > len(tag) {
+			return c, fmt.Errorf("short curve")
+		}
+		switch n {
+		case 0:
+			// Identity
+			c.parametric, c.params[0] = true, 1
+		case 1:
+			// Pure gamma, u8Fixed8
+			c.parametric, c.params[0] = true, float64(binary.BigEndian.Uint16(tag[12:]))/256
+		default:
+			c.table = make([]float64, n)
+			for i := range c.table {
+				c.table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+		}
+		return c, nil
+	case len(tag) >= 12 && string(tag[:4]) == "para":
+		c.funcType = int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if c.funcType >= len(counts) || 12+4*counts[c.funcType] > len(tag) {
+			return c, fmt.Errorf("unsupported parametric curve")
+		}
+		for i := 0; i < counts[c.funcType]; i++ {
+			c.params[i] = s15Fixed16(tag[12+4*i:])
+		}
+		c.parametric = true
+		return c, nil
+	}
+	return c, fmt.Errorf("missing curve")
+}
+
+// apply maps an encoded value in [0, 1] to linear light.
+func (c iccCurve) apply(x float64) float64 {
+	if !c.parametric {
+		pos := x * float64(len(c.table)-1)
+		i := int(pos)
+		if i >= len(c.table)-1 {
+			return c.table[len(c.table)-1]
+		}
+		frac := pos - float64(i)
+		return c.table[i]*(1-frac) + c.table[i+1]*frac
+	}
+	g, a, b, cc, d, e, f := c.params[0], c.params[1], c.params[2], c.params[3], c.params[4], c.params[5], c.params[6]
+	switch c.funcType {
+	case 1:
+		if x >= -b/a {
+			return math.Pow(a*x+b, g)
+		}
+		return 0
+	case 2:
+		if x >= -b/a {
+			return math.Pow(a*x+b, g) + cc
+		}
+		return cc
+	case 3:
+		if x >= d {
+			return math.Pow(a*x+b, g)
+		}
+		return cc * x
+	case 4:
+		if x >= d {
+			return math.Pow(a*x+b, g) + e
+		}
+		return cc*x + f
+	}
+	return math.Pow(x, g)
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// srgbEncode applies the sRGB transfer function to a linear value.
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// srgbDecode is the inverse of srgbEncode.
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// toSRGB returns the matrix from the profile's linear RGB to linear sRGB.
+func (p *iccProfile) toSRGB() [3][3]float64 {
+	return mulMatrix(invertMatrix(srgbToXYZD50), p.matrix)
+}
+
+// isSRGB reports whether converting with the profile would leave 8-bit
+// pixels (almost) unchanged.
+func (p *iccProfile) isSRGB() bool {
+	m := p.toSRGB()
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			want := 0.0
+			if row == col {
+				want = 1
+			}
+			if math.Abs(m[row][col]-want) > 0.002 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for v := 0; v < 256; v += 5 {
+			x := float64(v) / 255
+			if math.Abs(curve.apply(x)-srgbDecode(x)) > 0.5/255 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// convertToSRGB converts img from the profile's colour space to sRGB.
+// Colours outside the sRGB gamut are clipped.
+func convertToSRGB(img image.Image, p *iccProfile) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Src)
+
+	// 8-bit lookups on both sides of the matrix
+	var linear [3][256]float64
+	for c := range linear {
+		for v := range linear[c] {
+			linear[c][v] = p.curves[c].apply(float64(v) / 255)
+		}
+	}
+	const encodeSteps = 4096
+	var encode [encodeSteps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(srgbEncode(float64(i)/encodeSteps) * 255))
+	}
+
+	m := p.toSRGB()
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+4*dst.Rect.Dx()]
+		for x := 0; x < len(row); x += 4 {
+			r, g, bl := linear[0][row[x]], linear[1][row[x+1]], linear[2][row[x+2]]
+			for c := 0; c < 3; c++ {
+				v := m[c][0]*r + m[c][1]*g + m[c][2]*bl
+				// Written this way round so a NaN from a broken curve, which
+				// math.Max and math.Min pass through, ends up as 0
+				if !(v > 0) {
+					v = 0
+				} else if v > 1 {
+					v = 1
+				}
+				row[x+c] = encode[int(v*encodeSteps+0.5)]
+			}
+		}
+	}
+	return dst
+}
+
+func mulMatrix(a, b [3][3]float64) [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += a[i][k] * b[k][j]
+			}
+		}
+	}
+	return m
+}
+
+func invertMatrix(m [3][3]float64) [3][3]float64 {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// Cofactor of m[j][i]
+			r0, r1 := (j+1)%3, (j+2)%3
+			c0, c1 := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[r0][c0]*m[r1][c1] - m[r0][c1]*m[r1][c0]) / det
+		}
+	}
+	return inv
+}
@@ -1,29 +1,56 @@
 package services
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
-	"image/png"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"resizer/models"
 
 	"encoding/base64"
-
-	"github.com/nfnt/resize"
 )
 
 type ImageService struct {
-	db *sql.DB
+	db    *sql.DB
+	owner string // identifies this app instance on the tasks it claims
+
+	mu      sync.Mutex
+	running map[int64]context.CancelFunc // tasks this instance is processing
+
+	// queueChanged wakes the scheduler when a task becomes pending
+	queueChanged signal
 }
 
 func NewImageService(db *sql.DB) *ImageService {
-	return &ImageService{db: db}
+	return &ImageService{db: db, owner: newOwnerID(), running: make(map[int64]context.CancelFunc),
+		queueChanged: newSignal()}
+}
+
+// Task leases. A claimed task stays claimed while its lease is renewed; if
+// the app dies, the lease runs out and the task can be claimed again.
+const (
+	leaseDuration = 2 * time.Minute
+	leaseRenewal  = 30 * time.Second
+)
+
+// newOwnerID returns an ID unique to this process, even among app instances
+// on different machines sharing the database.
+func newOwnerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	var nonce [4]byte
+	rand.Read(nonce[:])
+	return fmt.Sprintf("%s:%d:%x", host, os.Getpid(), nonce)
 }
 
 func init() {
@@ -37,21 +64,56 @@ func init() {
 	time.Local = loc
 }
 
-func (i *ImageService) CreateImageTask(projectID int64, imagePath string, targetWidth, targetHeight int, scheduledFor time.Time) (*models.ImageTask, error) {
+func (i *ImageService) CreateImageTask(projectID int64, imagePath string, targetWidth, targetHeight int, scheduledFor time.Time, opts models.TaskOptions) (*models.ImageTask, error) {
+	return i.createTask(projectID, imagePath, targetWidth, targetHeight, scheduledFor, opts, 0, actorUser)
+}
+
+// createTask creates a task, made by actor and, for tasks from a recurring
+// schedule, scheduleID.
+func (i *ImageService) createTask(projectID int64, imagePath string, targetWidth, targetHeight int, scheduledFor time.Time, opts models.TaskOptions, scheduleID int64, actor string) (*models.ImageTask, error) {
+	if err := i.resolveTaskOptions(projectID, &opts, targetWidth, targetHeight); err != nil {
+		return nil, err
+	}
+
+	format, cfg, err := inspectImageFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image: %w", err)
+	}
+
+	renditions, err := json.Marshal(opts.Renditions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode renditions: %w", err)
+	}
+
 	task := &models.ImageTask{
 		ProjectID:    projectID,
 		ImagePath:    imagePath,
 		TargetWidth:  targetWidth,
 		TargetHeight: targetHeight,
-		Status:       "pending",
+		Status:       models.TaskPending,
 		CreatedAt:    time.Now(),
 		ScheduledFor: scheduledFor,
+		Format:       format.Name,
+		SourceWidth:  cfg.Width,
+		SourceHeight: cfg.Height,
+		ScheduleID:   scheduleID,
+		TaskOptions:  opts,
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	result, err := i.db.Exec(`
-		INSERT INTO image_tasks (project_id, image_path, target_width, target_height, status, created_at, scheduled_for)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, task.ProjectID, task.ImagePath, task.TargetWidth, task.TargetHeight, task.Status, task.CreatedAt, task.ScheduledFor)
+	result, err := tx.Exec(`
+		INSERT INTO image_tasks (project_id, image_path, target_width, target_height, status, created_at, scheduled_for, format, source_width, source_height,
+			resize_mode, gravity, background, output_format, jpeg_quality, png_compression, webp_quality, webp_mode, max_bytes, renditions, color_profile, resampler, linear_light, schedule_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, task.ProjectID, task.ImagePath, task.TargetWidth, task.TargetHeight, task.Status, task.CreatedAt, task.ScheduledFor,
+		task.Format, task.SourceWidth, task.SourceHeight,
+		task.ResizeMode, task.Gravity, task.Background, task.OutputFormat,
+		task.JPEGQuality, task.PNGCompression, task.WebPQuality, task.WebPMode, task.MaxBytes, string(renditions), task.ColorProfile, task.Resampler, task.LinearLight, task.ScheduleID)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create image task: %w", err)
@@ -61,21 +123,122 @@ func (i *ImageService) CreateImageTask(projectID int64, imagePath string, target
 	if err != nil {
 		return nil, fmt.Errorf("failed to get task ID: %w", err)
 	}
+	if err := recordEvent(tx, id, "", task.Status, actor, "created", time.Time{}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	i.queueChanged.notify()
 
 	task.ID = id
 	return task, nil
 }
 
+// resolveTaskOptions checks a task's options and fills in what it leaves
+// unset: encoder settings come from the project, then the defaults.
+func (i *ImageService) resolveTaskOptions(projectID int64, opts *models.TaskOptions, targetWidth, targetHeight int) error {
+	if err := normalizeTaskOptions(opts, targetWidth, targetHeight); err != nil {
+		return err
+	}
+
+	var projectDefaults models.EncoderSettings
+	err := i.db.QueryRow("SELECT jpeg_quality, png_compression, webp_quality, webp_mode FROM projects WHERE id = ?", projectID).Scan(
+		&projectDefaults.JPEGQuality,
+		&projectDefaults.PNGCompression,
+		&projectDefaults.WebPQuality,
+		&projectDefaults.WebPMode,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to get project settings: %w", err)
+	}
+	opts.EncoderSettings = withDefaults(withDefaults(opts.EncoderSettings, projectDefaults), defaultEncoderSettings)
+	return nil
+}
+
+// taskColumns is the image_tasks column list read by scanTask.
+const taskColumns = `id, project_id, image_path, target_width, target_height, status, created_at, scheduled_for,
+		format, source_width, source_height, output_path, resize_mode, gravity, background, output_format,
+		jpeg_quality, png_compression, webp_quality, webp_mode, max_bytes,
+		output_width, output_height, output_size, last_error, error_stack, renditions, color_profile, color_space, resampler, linear_light,
+		claimed_by, lease_expires, attempt_count, next_attempt_at, schedule_id`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTask reads a row selected with taskColumns.
+func scanTask(row rowScanner, task *models.ImageTask) error {
+	var renditions string
+	var leaseExpires, nextAttemptAt int64
+	err := row.Scan(
+		&task.ID,
+		&task.ProjectID,
+		&task.ImagePath,
+		&task.TargetWidth,
+		&task.TargetHeight,
+		&task.Status,
+		&task.CreatedAt,
+		&task.ScheduledFor,
+		&task.Format,
+		&task.SourceWidth,
+		&task.SourceHeight,
+		&task.OutputPath,
+		&task.ResizeMode,
+		&task.Gravity,
+		&task.Background,
+		&task.OutputFormat,
+		&task.JPEGQuality,
+		&task.PNGCompression,
+		&task.WebPQuality,
+		&task.WebPMode,
+		&task.MaxBytes,
+		&task.OutputWidth,
+		&task.OutputHeight,
+		&task.OutputSize,
+		&task.LastError,
+		&task.ErrorStack,
+		&renditions,
+		&task.ColorProfile,
+		&task.ColorSpace,
+		&task.Resampler,
+		&task.LinearLight,
+		&task.ClaimedBy,
+		&leaseExpires,
+		&task.AttemptCount,
+		&nextAttemptAt,
+		&task.ScheduleID,
+	)
+	if err != nil {
+		return err
+	}
+	if leaseExpires > 0 {
+		task.LeaseExpires = time.Unix(leaseExpires, 0)
+	}
+	if nextAttemptAt > 0 {
+		task.NextAttemptAt = time.Unix(nextAttemptAt, 0)
+	}
+	if renditions != "" {
+		if err := json.Unmarshal([]byte(renditions), &task.Renditions); err != nil {
+			return fmt.Errorf("failed to decode renditions: %w", err)
+		}
+	}
+	return nil
+}
+
 func (i *ImageService) GetPendingTasks() ([]models.ImageTask, error) {
 	now := time.Now()
 
 	rows, err := i.db.Query(`
-		SELECT id, project_id, image_path, target_width, target_height, status, created_at, scheduled_for
+		SELECT `+taskColumns+`
 		FROM image_tasks 
-		WHERE status = 'pending' 
-		AND datetime(scheduled_for, 'localtime') <= datetime(?, 'localtime')
+		WHERE status = ?
+		AND datetime(scheduled_for) <= ?
+		AND next_attempt_at <= ?
 		ORDER BY scheduled_for ASC
-	`, now.Format("2006-01-02 15:04:05"))
+	`, models.TaskPending, sqliteUTC(now), now.Unix())
 
 	if err != nil {
 		log.Printf("Error querying pending tasks: %v", err)
@@ -86,135 +249,456 @@ func (i *ImageService) GetPendingTasks() ([]models.ImageTask, error) {
 	var tasks []models.ImageTask
 	for rows.Next() {
 		var task models.ImageTask
-		err := rows.Scan(
-			&task.ID,
-			&task.ProjectID,
-			&task.ImagePath,
-			&task.TargetWidth,
-			&task.TargetHeight,
-			&task.Status,
-			&task.CreatedAt,
-			&task.ScheduledFor,
-		)
+		err := scanTask(rows, &task)
 		if err != nil {
 			log.Printf("Error scanning task: %v", err)
 			return nil, fmt.Errorf("failed to scan task: %w", err)
 		}
 
+		// SQLite compares whole seconds
 		if task.ScheduledFor.After(now) {
-			log.Printf("Skipping task %d: scheduled for %v MYT, current time %v MYT",
-				task.ID,
-				task.ScheduledFor.Format("2006-01-02 15:04:05 MST"),
-				now.Format("2006-01-02 15:04:05 MST"),
-			)
 			continue
 		}
-
-		log.Printf("Found pending task: ID=%d, ScheduledFor=%v MYT, CurrentTime=%v MYT",
-			task.ID,
-			task.ScheduledFor.Format("2006-01-02 15:04:05 MST"),
-			now.Format("2006-01-02 15:04:05 MST"),
-		)
 		tasks = append(tasks, task)
 	}
 
 	return tasks, nil
 }
 
-func (i *ImageService) ProcessImage(task *models.ImageTask) error {
-	log.Printf("Starting to process image task %d", task.ID)
-
-	// Update status to processing
-	_, err := i.db.Exec("UPDATE image_tasks SET status = 'processing' WHERE id = ?", task.ID)
+// nextTaskTime returns the first time after now that a pending task falls
+// due or a processing task's lease runs out, or the zero time if there is
+// none.
+func (i *ImageService) nextTaskTime(now time.Time) (time.Time, error) {
+	var next time.Time
+	rows, err := i.db.Query(`
+		SELECT scheduled_for, next_attempt_at
+		FROM image_tasks
+		WHERE status = ?
+	`, models.TaskPending)
 	if err != nil {
-		return fmt.Errorf("failed to update task status: %w", err)
+		return next, fmt.Errorf("failed to get pending tasks: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var scheduledFor time.Time
+		var nextAttemptAt int64
+		if err := rows.Scan(&scheduledFor, &nextAttemptAt); err != nil {
+			return next, fmt.Errorf("failed to scan task: %w", err)
+		}
+		due := scheduledFor
+		if retryAt := time.Unix(nextAttemptAt, 0); retryAt.After(due) {
+			due = retryAt
+		}
+		if due.After(now) && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return next, fmt.Errorf("failed to get pending tasks: %w", err)
 	}
-	log.Printf("Updated task %d status to processing", task.ID)
 
-	log.Printf("Opening source image: %s", task.ImagePath)
-	file, err := os.Open(task.ImagePath)
+	// Recovery takes a task once its lease is past, so a second later
+	var leaseExpires sql.NullInt64
+	err = i.db.QueryRow(`
+		SELECT MIN(lease_expires) FROM image_tasks WHERE status = ? AND lease_expires >= ?
+	`, models.TaskProcessing, now.Unix()).Scan(&leaseExpires)
 	if err != nil {
-		i.updateTaskStatus(task.ID, "failed")
-		return fmt.Errorf("failed to open image: %w", err)
+		return next, fmt.Errorf("failed to get task leases: %w", err)
 	}
-	defer file.Close()
+	if leaseExpires.Valid {
+		if expiry := time.Unix(leaseExpires.Int64+1, 0); next.IsZero() || expiry.Before(next) {
+			next = expiry
+		}
+	}
+	return next, nil
+}
 
-	// Decode gambar
-	var img image.Image
-	var decodeErr error
+// errTaskNotDue rejects a claim on a task scheduled for later.
+var errTaskNotDue = errors.New("task is not due yet")
 
-	ext := filepath.Ext(task.ImagePath)
-	log.Printf("Decoding image with extension: %s", ext)
+// sqliteUTC formats t as SQLite's datetime() returns it, so the two compare
+// as strings whatever the UTC offset scheduled_for was stored with.
+func sqliteUTC(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
 
-	switch ext {
-	case ".jpg", ".jpeg":
-		img, decodeErr = jpeg.Decode(file)
-	case ".png":
-		img, decodeErr = png.Decode(file)
-	default:
-		i.updateTaskStatus(task.ID, "failed")
-		return fmt.Errorf("unsupported image format")
+// ClaimTask moves a due pending task to processing for this app instance
+// and returns it, in one transaction so no two workers or app instances can
+// both win it. Each claim counts as an attempt. It returns nil when someone
+// else got there first or the task is no longer due. Tasks whose claim
+// lapsed are handled by RecoverOrphanedTasks.
+func (i *ImageService) ClaimTask(taskID int64) (*models.ImageTask, error) {
+	now := time.Now()
+	task := &models.ImageTask{}
+	_, err := i.transitionTask(taskID, taskChange{
+		action:    "claim",
+		from:      []models.TaskStatus{models.TaskPending},
+		to:        models.TaskProcessing,
+		set:       "claimed_by = ?, lease_expires = ?, attempt_count = attempt_count + 1",
+		setArgs:   []interface{}{i.owner, now.Add(leaseDuration).Unix()},
+		where:     "datetime(scheduled_for) <= ? AND next_attempt_at <= ?",
+		whereArgs: []interface{}{sqliteUTC(now), now.Unix()},
+		actor:     i.owner,
+		message:   "claimed for processing",
+		within: func(tx *sql.Tx) error {
+			err := scanTask(tx.QueryRow("SELECT "+taskColumns+" FROM image_tasks WHERE id = ?", taskID), task)
+			if err != nil {
+				return err
+			}
+			// SQLite compares whole seconds
+			if task.ScheduledFor.After(now) {
+				return errTaskNotDue
+			}
+			return nil
+		},
+	})
+	var notClaimable *transitionError
+	if errors.As(err, &notClaimable) || err == errTaskNotFound || err == errTaskNotDue {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim task: %w", err)
 	}
+	return task, nil
+}
 
-	if decodeErr != nil {
-		i.updateTaskStatus(task.ID, "failed")
-		return fmt.Errorf("failed to decode image: %w", decodeErr)
+// renewLease keeps this instance's claim on a task alive until the returned
+// function is called. If the claim is lost, say because the task was
+// cancelled, lost is called.
+func (i *ImageService) renewLease(taskID int64, lost func()) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(leaseRenewal)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				result, err := i.db.Exec(`
+					UPDATE image_tasks SET lease_expires = ?
+					WHERE id = ? AND claimed_by = ? AND status = ?
+				`, time.Now().Add(leaseDuration).Unix(), taskID, i.owner, models.TaskProcessing)
+				if err != nil {
+					log.Printf("Error renewing lease on task %d: %v", taskID, err)
+					continue
+				}
+				if n, _ := result.RowsAffected(); n == 0 {
+					log.Printf("Lost the claim on task %d", taskID)
+					lost()
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
 	}
-	log.Printf("Successfully decoded image for task %d", task.ID)
+}
 
-	// Resize gambar
-	log.Printf("Resizing image to %dx%d", task.TargetWidth, task.TargetHeight)
-	resized := resize.Resize(uint(task.TargetWidth), uint(task.TargetHeight), img, resize.Lanczos3)
-	log.Printf("Successfully resized image for task %d", task.ID)
+// ProcessImage processes a task claimed with ClaimTask. It stops early when
+// ctx is cancelled or the task is cancelled with CancelTask.
+func (i *ImageService) ProcessImage(ctx context.Context, task *models.ImageTask) error {
+	log.Printf("Starting to process image task %d", task.ID)
 
-	// Create output directory kalau tak wujud
-	outputDir := filepath.Join(filepath.Dir(filepath.Dir(task.ImagePath)), "resized")
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		i.updateTaskStatus(task.ID, "failed")
-		return fmt.Errorf("failed to create output directory: %w", err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	i.trackRunning(task.ID, cancel)
+	defer i.untrackRunning(task.ID)
+
+	// Hold on to the claim for as long as the task runs
+	stopRenewing := i.renewLease(task.ID, cancel)
+	defer stopRenewing()
+
+	// Gather everything the job needs from the database up front. The retry
+	// policy comes first, so failures reading the rest can be retried too
+	retry, err := loadRetryPolicy(i.db, task.ProjectID)
+	if err != nil {
+		return i.failTask(task, retry, err)
+	}
+	job := &taskJob{Task: *task}
+	if job.Limits, err = loadLimits(i.db); err != nil {
+		return i.failTask(task, retry, err)
+	}
+	err = i.db.QueryRow("SELECT metadata_policy FROM projects WHERE id = ?", task.ProjectID).Scan(&job.Policy)
+	if err != nil {
+		return i.failTask(task, retry, fmt.Errorf("failed to get project metadata policy: %w", err))
+	}
+	useWorker, err := loadWorkerProcess(i.db)
+	if err != nil {
+		return i.failTask(task, retry, err)
 	}
-	log.Printf("Created output directory: %s", outputDir)
 
-	// Create output file
-	outputPath := filepath.Join(outputDir, filepath.Base(task.ImagePath))
-	log.Printf("Creating output file: %s", outputPath)
-	out, err := os.Create(outputPath)
+	var result *taskResult
+	if useWorker {
+		log.Printf("Processing task %d in a worker process", task.ID)
+		result, err = runJobInWorker(ctx, job)
+	} else {
+		result, err = runJobSafely(ctx, job)
+	}
+	if ctx.Err() != nil {
+		return i.abandonTask(task)
+	}
+
+	// Record what was learnt about the source, even when processing failed
+	if result != nil && result.Format != "" {
+		task.Format, task.SourceWidth, task.SourceHeight = result.Format, result.SourceWidth, result.SourceHeight
+		task.ColorSpace = result.ColorSpace
+		_, dbErr := i.db.Exec("UPDATE image_tasks SET format = ?, source_width = ?, source_height = ?, color_space = ? WHERE id = ?",
+			task.Format, task.SourceWidth, task.SourceHeight, task.ColorSpace, task.ID)
+		if dbErr != nil && err == nil {
+			err = fmt.Errorf("failed to record image format: %w", dbErr)
+		}
+	}
 	if err != nil {
-		i.updateTaskStatus(task.ID, "failed")
-		return fmt.Errorf("failed to create output file: %w", err)
+		return i.failTask(task, retry, err)
+	}
+
+	// Record what was produced, and any settings the size search chose for
+	// the main output, completing the task
+	outputs := result.Outputs
+	task.EncoderSettings = result.EncoderSettings
+	task.OutputPath = outputs[0].Path
+	task.OutputWidth, task.OutputHeight = outputs[0].Width, outputs[0].Height
+	task.OutputSize = outputs[0].Size
+	if err := i.saveOutputs(task, outputs, result.Notes); err == errClaimLost {
+		return i.abandonTask(task)
+	} else if err != nil {
+		return i.failTask(task, retry, err)
 	}
-	defer out.Close()
+	return nil
+}
 
-	// Save the resized image
-	log.Printf("Saving resized image for task %d", task.ID)
-	switch filepath.Ext(task.ImagePath) {
-	case ".jpg", ".jpeg":
-		err = jpeg.Encode(out, resized, nil)
-	case ".png":
-		err = png.Encode(out, resized)
+// taskTargets lists the outputs of a task: its own target first, then any
+// extra renditions.
+func taskTargets(task *models.ImageTask) []models.Rendition {
+	return append([]models.Rendition{{Width: task.TargetWidth, Height: task.TargetHeight}}, task.Renditions...)
+}
+
+// planTarget plans the resize of a srcW x srcH source to one of the task's
+// targets.
+func planTarget(task *models.ImageTask, target models.Rendition, srcW, srcH int) (resizePlan, error) {
+	sized := *task
+	sized.TargetWidth, sized.TargetHeight = target.Width, target.Height
+	return planResize(srcW, srcH, &sized)
+}
+
+// writeOutput resizes, encodes and saves one output of a task. Outputs are
+// named after the source and the task ID, so tasks on the same source never
+// share a file; renditions add their size to the name.
+// Nothing is saved once ctx is cancelled.
+func writeOutput(ctx context.Context, task *models.ImageTask, src *decodedImage, sourceFormat *imageFormat, target models.Rendition, main bool) (models.TaskOutput, models.EncoderSettings, error) {
+	output := models.TaskOutput{TaskID: task.ID}
+	settings := task.EncoderSettings
+
+	outFormat := sourceFormat
+	if name := firstNonEmpty(target.Format, task.OutputFormat); name != "" {
+		if outFormat = formatByName(name); outFormat == nil {
+			return output, settings, fmt.Errorf("unsupported output format %q", name)
+		}
 	}
 
+	srcW, srcH := src.size()
+	plan, err := planTarget(task, target, srcW, srcH)
 	if err != nil {
-		i.updateTaskStatus(task.ID, "failed")
-		return fmt.Errorf("failed to save resized image: %w", err)
+		return output, settings, fmt.Errorf("invalid resize settings: %w", err)
 	}
-	log.Printf("Successfully saved resized image for task %d", task.ID)
 
-	// Update status to completed
-	return i.updateTaskStatus(task.ID, "completed")
+	// Resize and encode gambar
+	var data []byte
+	if task.MaxBytes > 0 {
+		log.Printf("Fitting %s output under %d bytes", outFormat.Name, task.MaxBytes)
+		data, plan, settings, err = fitToSize(ctx, src, plan, outFormat, settings, task.MaxBytes)
+		if err != nil {
+			return output, settings, err
+		}
+	} else {
+		log.Printf("Resizing image to %dx%d %s (%s)", plan.canvas.X, plan.canvas.Y, outFormat.Name, task.ResizeMode)
+		data, err = src.encode(ctx, plan, outFormat, settings)
+		if err != nil {
+			return output, settings, fmt.Errorf("failed to encode resized image: %w", err)
+		}
+	}
+
+	suffix := fmt.Sprintf("-%d", task.ID)
+	if !main {
+		suffix += fmt.Sprintf("-%dx%d", plan.canvas.X, plan.canvas.Y)
+	}
+	outputPath := outFormat.outputPath(task.ImagePath, suffix)
+
+	// Create output directory kalau tak wujud
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return output, settings, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	log.Printf("Saving resized image to %s", outputPath)
+	if err := writeFileAtomic(outputPath, data); err != nil {
+		return output, settings, fmt.Errorf("failed to save resized image: %w", err)
+	}
+
+	output.Path = outputPath
+	output.Format = outFormat.Name
+	output.Width, output.Height = plan.canvas.X, plan.canvas.Y
+	output.Size = int64(len(data))
+	output.CreatedAt = time.Now()
+	return output, settings, nil
 }
 
-func (i *ImageService) updateTaskStatus(taskID int64, status string) error {
-	_, err := i.db.Exec("UPDATE image_tasks SET status = ? WHERE id = ?", status, taskID)
+// saveOutputs records a task's outputs, replacing those of any earlier run,
+// and stores the main output and its settings on the task itself, marking
+// it completed, with notes in the completion event. It returns errClaimLost,
+// recording nothing, if the task was cancelled or taken over meanwhile.
+func (i *ImageService) saveOutputs(task *models.ImageTask, outputs []models.TaskOutput, notes []string) error {
+	message := "saved " + task.OutputPath
+	for _, note := range notes {
+		message += "; " + note
+	}
+	_, err := i.transitionTask(task.ID, taskChange{
+		action: "complete",
+		from:   []models.TaskStatus{models.TaskProcessing},
+		to:     models.TaskCompleted,
+		set: `output_path = ?, output_width = ?, output_height = ?, output_size = ?,
+			jpeg_quality = ?, png_compression = ?, webp_quality = ?, webp_mode = ?, last_error = '', error_stack = ''`,
+		setArgs: []interface{}{task.OutputPath, task.OutputWidth, task.OutputHeight, task.OutputSize,
+			task.JPEGQuality, task.PNGCompression, task.WebPQuality, task.WebPMode},
+		where:     "claimed_by = ?",
+		whereArgs: []interface{}{i.owner},
+		actor:     i.owner,
+		message:   message,
+		within: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("DELETE FROM task_outputs WHERE task_id = ?", task.ID); err != nil {
+				return fmt.Errorf("failed to clear task outputs: %w", err)
+			}
+			for n := range outputs {
+				output := &outputs[n]
+				result, err := tx.Exec(`
+					INSERT INTO task_outputs (task_id, path, format, width, height, size, created_at)
+					VALUES (?, ?, ?, ?, ?, ?, ?)
+				`, output.TaskID, output.Path, output.Format, output.Width, output.Height, output.Size, output.CreatedAt)
+				if err != nil {
+					return fmt.Errorf("failed to record task output: %w", err)
+				}
+				if output.ID, err = result.LastInsertId(); err != nil {
+					return fmt.Errorf("failed to get output ID: %w", err)
+				}
+			}
+			return nil
+		},
+	})
+	var lost *transitionError
+	if errors.As(err, &lost) || err == errTaskNotFound {
+		return errClaimLost
+	}
 	if err != nil {
-		return fmt.Errorf("failed to update task status: %w", err)
+		return err
 	}
+	task.Status = models.TaskCompleted
 	return nil
 }
 
+// GetTaskOutputs returns every file written by a task, main output first.
+func (i *ImageService) GetTaskOutputs(taskID int64) ([]models.TaskOutput, error) {
+	rows, err := i.db.Query(`
+		SELECT id, task_id, path, format, width, height, size, created_at
+		FROM task_outputs
+		WHERE task_id = ?
+		ORDER BY id ASC
+	`, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task outputs: %w", err)
+	}
+	defer rows.Close()
+
+	var outputs []models.TaskOutput
+	for rows.Next() {
+		var output models.TaskOutput
+		err := rows.Scan(
+			&output.ID,
+			&output.TaskID,
+			&output.Path,
+			&output.Format,
+			&output.Width,
+			&output.Height,
+			&output.Size,
+			&output.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task output: %w", err)
+		}
+		outputs = append(outputs, output)
+	}
+
+	return outputs, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// failTask records why a task's run failed and, for crashes, the stack
+// trace, and returns err. A transient failure puts the task back to pending
+// to be retried after a backoff, until the project's retry policy runs out
+// of attempts; anything else fails the task for good.
+func (i *ImageService) failTask(task *models.ImageTask, retry models.RetryPolicy, err error) error {
+	var stack string
+	var crash *crashError
+	if errors.As(err, &crash) {
+		stack = crash.Stack
+	}
+
+	change := taskChange{
+		action:    "fail",
+		from:      []models.TaskStatus{models.TaskProcessing},
+		to:        models.TaskFailed,
+		set:       "last_error = ?, error_stack = ?, next_attempt_at = ?",
+		setArgs:   []interface{}{err.Error(), stack, int64(0)},
+		where:     "claimed_by = ?",
+		whereArgs: []interface{}{i.owner},
+		actor:     i.owner,
+		message:   err.Error(),
+	}
+	var nextAttempt time.Time
+	if isTransient(err) && task.AttemptCount < retry.MaxAttempts {
+		delay := retryBackoff(retry, task.AttemptCount)
+		nextAttempt = time.Now().Add(delay)
+		change.to, change.setArgs[2], change.retryAt = models.TaskPending, nextAttempt.Unix(), nextAttempt
+		change.message = fmt.Sprintf("attempt %d of %d failed, retrying in %v: %v", task.AttemptCount, retry.MaxAttempts, delay, err)
+		log.Printf("Task %d failed on attempt %d of %d, retrying in %v: %v", task.ID, task.AttemptCount, retry.MaxAttempts, delay, err)
+	} else {
+		log.Printf("Task %d failed: %v", task.ID, err)
+		if stack != "" {
+			log.Printf("Task %d stack trace:\n%s", task.ID, stack)
+		}
+	}
+
+	_, dbErr := i.transitionTask(task.ID, change)
+	var lost *transitionError
+	if errors.As(dbErr, &lost) {
+		// Cancelled or taken over meanwhile
+		return err
+	}
+	if dbErr != nil {
+		log.Printf("Error marking task %d as %s: %v", task.ID, change.to, dbErr)
+		return err
+	}
+	task.Status, task.LastError, task.ErrorStack, task.NextAttemptAt = change.to, err.Error(), stack, nextAttempt
+	return err
+}
+
 func (i *ImageService) GetProjectTasks(projectID int64) ([]models.ImageTask, error) {
 	rows, err := i.db.Query(`
-		SELECT id, project_id, image_path, target_width, target_height, status, created_at, scheduled_for
+		SELECT `+taskColumns+`
 		FROM image_tasks 
 		WHERE project_id = ?
 		ORDER BY created_at DESC
@@ -228,21 +712,18 @@ func (i *ImageService) GetProjectTasks(projectID int64) ([]models.ImageTask, err
 	var tasks []models.ImageTask
 	for rows.Next() {
 		var task models.ImageTask
-		err := rows.Scan(
-			&task.ID,
-			&task.ProjectID,
-			&task.ImagePath,
-			&task.TargetWidth,
-			&task.TargetHeight,
-			&task.Status,
-			&task.CreatedAt,
-			&task.ScheduledFor,
-		)
+		err := scanTask(rows, &task)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan task: %w", err)
 		}
 		tasks = append(tasks, task)
 	}
+	rows.Close()
+
+	// Each task's status history, for its timeline
+	if err := i.loadTaskEvents(projectID, tasks); err != nil {
+		return nil, err
+	}
 
 	return tasks, nil
 }
@@ -261,6 +742,36 @@ func (i *ImageService) SaveUploadedFile(projectID int64, fileData []byte, fileNa
 		return "", fmt.Errorf("failed to create uploads directory: %w", err)
 	}
 
+	limits, err := loadLimits(i.db)
+	if err != nil {
+		return "", err
+	}
+	if err := checkFileSize(limits, int64(len(fileData))); err != nil {
+		return "", fmt.Errorf("cannot upload %s: %w", fileName, err)
+	}
+
+	// Check the content really is a supported image matching its extension
+	format, cfg, err := inspectImage(fileData)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", fileName, err)
+	}
+	if err := checkExtension(fileName, format); err != nil {
+		return "", err
+	}
+
+	// Reject images too big to ever decode. Targets aren't known yet, so
+	// only the full-size decode counts towards memory.
+	memory, err := sourceMemory(fileData, format, cfg, 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", fileName, err)
+	}
+	if err := checkPixels(limits, cfg); err != nil {
+		return "", fmt.Errorf("cannot upload %s: %w", fileName, err)
+	}
+	if err := checkMemory(limits, memory); err != nil {
+		return "", fmt.Errorf("cannot upload %s: %w", fileName, err)
+	}
+
 	// Generate unique filename
 	timestamp := time.Now().UnixNano()
 	ext := filepath.Ext(fileName)
@@ -285,10 +796,17 @@ func (i *ImageService) GetImageData(filePath string) (string, error) {
 	return base64.StdEncoding.EncodeToString(data), nil
 }
 
-func (i *ImageService) GetResizedImageData(filePath string) (string, error) {
+func (i *ImageService) GetResizedImageData(taskID int64) (string, error) {
 
-	outputDir := filepath.Join(filepath.Dir(filepath.Dir(filePath)), "resized")
-	resizedPath := filepath.Join(outputDir, filepath.Base(filePath))
+	var imagePath, resizedPath string
+	err := i.db.QueryRow("SELECT image_path, output_path FROM image_tasks WHERE id = ?", taskID).Scan(&imagePath, &resizedPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to get task: %w", err)
+	}
+	if resizedPath == "" {
+		// Tasks processed before output paths were recorded
+		resizedPath = filepath.Join(filepath.Dir(filepath.Dir(imagePath)), "resized", filepath.Base(imagePath))
+	}
 
 	data, err := os.ReadFile(resizedPath)
 	if err != nil {
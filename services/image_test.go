@@ -0,0 +1,265 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"resizer/models"
+)
+
+// newTestProject returns an image service on a fresh database holding one
+// project, and a PNG source uploaded to it.
+func newTestProject(t *testing.T) (*ImageService, int64, string) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := models.InitDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	result, err := db.Exec("INSERT INTO projects (name, description, creation_time, location) VALUES ('test', '', ?, ?)",
+		time.Now(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectID, _ := result.LastInsertId()
+
+	source := filepath.Join(dir, "uploads", "photo.png")
+	if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, testImage("nrgba", 120, 90)); err != nil {
+		t.Fatal(err)
+	}
+	return NewImageService(db), projectID, source
+}
+
+// runTestTask claims and processes a task, failing the test if it doesn't
+// complete.
+func runTestTask(t *testing.T, svc *ImageService, task *models.ImageTask) *models.ImageTask {
+	t.Helper()
+	claimed, err := svc.ClaimTask(task.ID)
+	if err != nil || claimed == nil {
+		t.Fatalf("claim task %d: %v", task.ID, err)
+	}
+	if err := svc.ProcessImage(context.Background(), claimed); err != nil {
+		t.Fatalf("process task %d: %v", task.ID, err)
+	}
+	return claimed
+}
+
+func TestTasksOnOneSourceKeepTheirOutputs(t *testing.T) {
+	svc, projectID, source := newTestProject(t)
+
+	// Same source and settings twice, plus a second size
+	var tasks []*models.ImageTask
+	for _, size := range []int{60, 60, 30} {
+		task, err := svc.CreateImageTask(projectID, source, size, 0, time.Now(), models.TaskOptions{
+			ResizeMode: models.ResizeFit,
+			Renditions: []models.Rendition{{Width: size / 2}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+	for _, task := range tasks {
+		runTestTask(t, svc, task)
+	}
+
+	seen := make(map[string]int64)
+	for _, task := range tasks {
+		outputs, err := svc.GetTaskOutputs(task.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outputs) != 2 {
+			t.Fatalf("task %d has %d outputs, want 2", task.ID, len(outputs))
+		}
+		for _, output := range outputs {
+			if owner, ok := seen[output.Path]; ok {
+				t.Fatalf("tasks %d and %d both wrote %s", owner, task.ID, output.Path)
+			}
+			seen[output.Path] = task.ID
+
+			info, err := os.Stat(output.Path)
+			if err != nil {
+				t.Fatalf("output of task %d: %v", task.ID, err)
+			}
+			if info.Size() != output.Size {
+				t.Errorf("%s is %d bytes, task %d recorded %d", output.Path, info.Size(), task.ID, output.Size)
+			}
+			f, err := os.Open(output.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := png.DecodeConfig(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != output.Width || cfg.Height != output.Height {
+				t.Errorf("%s is %dx%d, task %d recorded %dx%d", output.Path, cfg.Width, cfg.Height, task.ID,
+					output.Width, output.Height)
+			}
+		}
+	}
+}
+
+func TestRemovePartialOutputsKeepsOtherTasksFiles(t *testing.T) {
+	svc, projectID, source := newTestProject(t)
+
+	var tasks []*models.ImageTask
+	for n := 0; n < 2; n++ {
+		task, err := svc.CreateImageTask(projectID, source, 60, 45, time.Now(), models.TaskOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks = append(tasks, task)
+	}
+
+	// Both tasks part way through writing their outputs
+	var temps []string
+	for _, task := range tasks {
+		path := formatByName("png").outputPath(source, fmt.Sprintf("-%d", task.ID))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		dir, name := filepath.Split(path)
+		temp := filepath.Join(dir, "."+name+tempSuffix+"123")
+		if err := os.WriteFile(temp, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		temps = append(temps, temp)
+	}
+
+	if err := svc.removePartialOutputs(tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(temps[0]); !os.IsNotExist(err) {
+		t.Errorf("task %d's temp file is still there", tasks[0].ID)
+	}
+	if _, err := os.Stat(temps[1]); err != nil {
+		t.Errorf("task %d's temp file was removed: %v", tasks[1].ID, err)
+	}
+}
+
+func TestLostMetadataIsNoted(t *testing.T) {
+	svc, projectID, source := newTestProject(t)
+
+	// A JPEG source with a comment, which GIF and WebP can't store
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage("nrgba", 80, 60), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	comment := []byte{0xff, 0xfe, 0, 7, 'h', 'e', 'l', 'l', 'o'}
+	data = append(data[:2:2], append(comment, data[2:]...)...)
+	source = strings.TrimSuffix(source, ".png") + ".jpg"
+	if err := os.WriteFile(source, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := svc.CreateImageTask(projectID, source, 40, 0, time.Now(), models.TaskOptions{
+		ResizeMode:   models.ResizeFit,
+		OutputFormat: "gif",
+		Renditions:   []models.Rendition{{Width: 20, Format: "webp"}, {Width: 30, Format: "jpeg"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestTask(t, svc, task)
+
+	tasks, err := svc.GetProjectTasks(projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message string
+	for _, event := range tasks[0].Events {
+		if event.To == models.TaskCompleted {
+			message = event.Message
+		}
+	}
+	for _, want := range []string{
+		"gif output can't store the source's comments",
+		"webp output can't store the source's comments",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("completion event %q doesn't say %q", message, want)
+		}
+	}
+	if strings.Contains(message, "jpeg output") {
+		t.Errorf("completion event %q has a note for the JPEG output", message)
+	}
+}
+
+func TestRecoverTasksOfExitedProcesses(t *testing.T) {
+	svc, projectID, source := newTestProject(t)
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// A process that has exited, and one that is still running
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	owners := map[string]bool{
+		fmt.Sprintf("%s:%d:0000", host, exited.Process.Pid):  true,
+		fmt.Sprintf("%s:%d:0000", host, os.Getppid()):        false,
+		fmt.Sprintf("elsewhere:%d:0000", exited.Process.Pid): false,
+	}
+
+	tasks := make(map[string]int64)
+	for owner := range owners {
+		task, err := svc.CreateImageTask(projectID, source, 60, 45, time.Now(), models.TaskOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTestTask(t, svc, task)
+		// Left processing with plenty of lease to go
+		_, err = svc.db.Exec("UPDATE image_tasks SET status = ?, claimed_by = ?, lease_expires = ? WHERE id = ?",
+			models.TaskProcessing, owner, time.Now().Add(time.Hour).Unix(), task.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tasks[owner] = task.ID
+	}
+
+	n, err := svc.RecoverOrphanedTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("recovered %d tasks, want 1", n)
+	}
+	for owner, gone := range owners {
+		var status models.TaskStatus
+		if err := svc.db.QueryRow("SELECT status FROM image_tasks WHERE id = ?", tasks[owner]).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		want := models.TaskProcessing
+		if gone {
+			want = models.TaskPending
+		}
+		if status != want {
+			t.Errorf("task left by %s is %s, want %s", owner, status, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	"resizer/models"
+)
+
+// taskJob is everything needed to turn a task's source into its outputs.
+// It doesn't touch the database, so it can run in a worker process.
+type taskJob struct {
+	Task   models.ImageTask `json:"task"`
+	Policy string           `json:"policy"` // the project's metadata policy
+	Limits models.Limits    `json:"limits"`
+}
+
+// taskResult is what a job found out and produced. Source details are
+// filled in as soon as they're known, so they survive a later failure.
+type taskResult struct {
+	Format          string                 `json:"format"`
+	SourceWidth     int                    `json:"source_width"`
+	SourceHeight    int                    `json:"source_height"`
+	ColorSpace      string                 `json:"color_space"`
+	EncoderSettings models.EncoderSettings `json:"encoder_settings"` // as used for the main output
+	Outputs         []models.TaskOutput    `json:"outputs"`
+	// Notes are things the user should know about the outputs, such as
+	// metadata an output format couldn't store
+	Notes []string `json:"notes"`
+}
+
+// crashError is a task failure caused by a crash rather than a bad input or
+// setting: a recovered panic, or a worker process that died.
+type crashError struct {
+	Message string
+	Stack   string
+}
+
+func (e *crashError) Error() string {
+	return e.Message
+}
+
+// runJobSafely runs job, turning a panic in a decoder, resampler or encoder
+// into an error so the task fails instead of the app.
+func runJobSafely(ctx context.Context, job *taskJob) (result *taskResult, err error) {
+	result = &taskResult{}
+	defer func() {
+		if v := recover(); v != nil {
+			stack := debug.Stack()
+			if band, ok := v.(*bandPanic); ok {
+				v, stack = band.value, band.stack
+			}
+			err = &crashError{Message: fmt.Sprintf("panic: %v", v), Stack: string(stack)}
+		}
+	}()
+	return result, runJob(ctx, job, result)
+}
+
+// runJob reads, checks, decodes and resizes the task's source and writes
+// every output file, filling in result along the way. It gives up as soon
+// as it can once ctx is cancelled.
+func runJob(ctx context.Context, job *taskJob, result *taskResult) error {
+	task := &job.Task
+	limits := job.Limits
+
+	// Check the file size before reading the whole file in
+	log.Printf("Opening source image: %s", task.ImagePath)
+	info, err := os.Stat(task.ImagePath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	if err := checkFileSize(limits, info.Size()); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(task.ImagePath)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+
+	// Detect the format from the file content, not the extension
+	format, cfg, err := inspectImage(data)
+	if err != nil {
+		return err
+	}
+	result.Format, result.SourceWidth, result.SourceHeight = format.Name, cfg.Width, cfg.Height
+
+	// The header's dimensions decide whether decoding is safe at all
+	if err := checkPixels(limits, cfg); err != nil {
+		return err
+	}
+	shrink := shrinkFactor(format, cfg.Width, cfg.Height, task)
+	memory, err := taskMemory(data, format, cfg, shrink, task)
+	if err != nil {
+		return fmt.Errorf("failed to read %s structure: %w", format.Name, err)
+	}
+	if err := checkMemory(limits, memory); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Decode gambar, straight at a fraction of the size when that's enough
+	if shrink > 1 {
+		log.Printf("Decoding %s image (%dx%d) at 1/%d scale", format.Name, cfg.Width, cfg.Height, shrink)
+	} else {
+		log.Printf("Decoding %s image (%dx%d)", format.Name, cfg.Width, cfg.Height)
+	}
+	src, err := decodeImage(data, format, shrink)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+	log.Printf("Successfully decoded image for task %d", task.ID)
+
+	// Keep only the metadata the project allows
+	src.meta.applyPolicy(job.Policy)
+
+	// Colour profile: convert to sRGB or carry the source profile through
+	result.ColorSpace = src.prepareColor(task.ColorProfile)
+
+	targets := taskTargets(task)
+	result.Outputs = make([]models.TaskOutput, 0, len(targets))
+	for n, target := range targets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		output, settings, err := writeOutput(ctx, task, src, format, target, n == 0)
+		if err != nil {
+			return err
+		}
+		// Different sizes can still come out the same, say fit to 800x600
+		// and to 800x0 on a 4:3 source
+		for _, earlier := range result.Outputs {
+			if earlier.Path == output.Path {
+				return fmt.Errorf("rendition %dx%d comes out the same as an earlier output: %s",
+					target.Width, target.Height, output.Path)
+			}
+		}
+		if n == 0 {
+			result.EncoderSettings = settings
+		}
+		result.Outputs = append(result.Outputs, output)
+
+		if lost := src.meta.lostIn(output.Format); len(lost) > 0 {
+			note := fmt.Sprintf("%s output can't store the source's %s", output.Format, strings.Join(lost, ", "))
+			if !hasNote(result.Notes, note) {
+				log.Printf("Task %d: %s", task.ID, note)
+				result.Notes = append(result.Notes, note)
+			}
+		}
+	}
+	return nil
+}
+
+func hasNote(notes []string, note string) bool {
+	for _, n := range notes {
+		if n == note {
+			return true
+		}
+	}
+	return false
+}
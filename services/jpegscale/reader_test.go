@@ -0,0 +1,239 @@
+package jpegscale
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// scaleTestFiles are the standard library's own test images, 150x103 so
+// neither side is a whole number of blocks at any scale.
+var scaleTestFiles = []string{
+	"video-001.jpeg", // 4:2:0
+	"video-001.q50.444.jpeg",
+	"video-001.q50.422.jpeg",
+	"video-001.q50.420.jpeg",
+	"video-001.q50.440.jpeg",
+	"video-001.q50.411.jpeg",
+	"video-001.progressive.jpeg",
+	"video-001.q50.444.progressive.jpeg",
+	"video-001.q50.422.progressive.jpeg",
+	"video-001.q50.420.progressive.jpeg",
+	"video-001.q50.440.progressive.jpeg",
+	"video-001.restart2.jpeg",
+	"video-001.rgb.jpeg",
+	"video-001.cmyk.jpeg",
+	"video-005.gray.jpeg",
+	"video-005.gray.q50.progressive.jpeg",
+}
+
+// smoothImage returns a w x h image of slow waves.
+func smoothImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x), float64(y)
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(128 + 100*math.Sin(fx/9)),
+				G: uint8(128 + 100*math.Cos(fy/7)),
+				B: uint8(128 + 80*math.Sin((fx+fy)/13)),
+				A: 0xff,
+			})
+		}
+	}
+	return img
+}
+
+// scaleTestImages returns the test files plus images the standard library
+// encodes at sizes that are odd in both directions, and a YCCK image.
+func scaleTestImages(t testing.TB) map[string][]byte {
+	t.Helper()
+	images := make(map[string][]byte)
+	for _, name := range scaleTestFiles {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		images[name] = data
+	}
+
+	// The CMYK file relabelled as YCCK: the pixels change, but it is still
+	// a valid file that both decoders have to read the same way
+	cmyk := images["video-001.cmyk.jpeg"]
+	adobe := bytes.Index(cmyk, []byte("Adobe"))
+	if adobe < 0 {
+		t.Fatal("no Adobe segment in the CMYK test file")
+	}
+	ycck := append([]byte(nil), cmyk...)
+	ycck[adobe+11] = adobeTransformYCbCrK
+	images["ycck"] = ycck
+
+	for _, size := range []struct{ w, h int }{{1, 1}, {7, 3}, {33, 17}, {101, 67}} {
+		rgb := smoothImage(size.w, size.h)
+		gray := image.NewGray(rgb.Rect)
+		draw.Draw(gray, gray.Rect, rgb, image.Point{}, draw.Src)
+		for name, img := range map[string]image.Image{"": rgb, " gray": gray} {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+				t.Fatal(err)
+			}
+			images[fmt.Sprintf("%dx%d%s", size.w, size.h, name)] = buf.Bytes()
+		}
+	}
+	return images
+}
+
+// channels returns the samples of img at (x, y), in the order of the
+// components they come from.
+func channels(img image.Image, x, y int) []uint8 {
+	switch img := img.(type) {
+	case *image.Gray:
+		return []uint8{img.GrayAt(x, y).Y}
+	case *image.YCbCr:
+		c := img.YCbCrAt(x, y)
+		return []uint8{c.Y, c.Cb, c.Cr}
+	case *image.RGBA:
+		c := img.RGBAAt(x, y)
+		return []uint8{c.R, c.G, c.B}
+	case *image.CMYK:
+		c := img.CMYKAt(x, y)
+		return []uint8{c.C, c.M, c.Y, c.K}
+	}
+	panic(fmt.Sprintf("unexpected image type %T", img))
+}
+
+// subsampling returns how many pixels across and down each component's
+// samples cover.
+func subsampling(t *testing.T, data []byte) [][2]int {
+	t.Helper()
+	d := decoder{scale: 1}
+	if _, err := d.decode(bytes.NewReader(data), true); err != nil {
+		t.Fatal(err)
+	}
+	hMax, vMax := 1, 1
+	for _, c := range d.comp[:d.nComp] {
+		hMax, vMax = max(hMax, c.h), max(vMax, c.v)
+	}
+	factors := make([][2]int, d.nComp)
+	for i, c := range d.comp[:d.nComp] {
+		factors[i] = [2]int{hMax / c.h, vMax / c.v}
+	}
+	return factors
+}
+
+func TestDecodeMatchesStandardLibrary(t *testing.T) {
+	// Mean difference per sample from the full size decode averaged down,
+	// a little above what the decoder gives today. Full size decodes are
+	// identical. A scaled IDCT is not a box filter, so single samples at
+	// sharp edges can be far off; YCCK is converted to CMYK after scaling.
+	maxMean := map[int]float64{1: 0, 2: 4, 4: 6, 8: 6}
+
+	for name, data := range scaleTestImages(t) {
+		want, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: image/jpeg: %v", name, err)
+		}
+		factors := subsampling(t, data)
+		full := want.Bounds()
+
+		for _, scale := range []int{1, 2, 4, 8} {
+			t.Run(fmt.Sprintf("%s/1:%d", name, scale), func(t *testing.T) {
+				got, err := Decode(bytes.NewReader(data), scale)
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				size := image.Rect(0, 0, (full.Dx()+scale-1)/scale, (full.Dy()+scale-1)/scale)
+				if got.Bounds() != size {
+					t.Fatalf("bounds %v, want %v", got.Bounds(), size)
+				}
+				if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", want) {
+					t.Fatalf("decoded to %T, image/jpeg gives %T", got, want)
+				}
+				if got, ok := got.(*image.YCbCr); ok && got.SubsampleRatio != want.(*image.YCbCr).SubsampleRatio {
+					t.Fatalf("subsampling %v, image/jpeg gives %v", got.SubsampleRatio, want.(*image.YCbCr).SubsampleRatio)
+				}
+
+				// Each sample is compared with the mean of the full size
+				// pixels it covers, at its component's own resolution
+				worst, total, n := 0, 0, 0
+				for y := 0; y < size.Dy(); y++ {
+					for x := 0; x < size.Dx(); x++ {
+						have := channels(got, x, y)
+						for c, f := range factors[:len(have)] {
+							w, h := f[0]*scale, f[1]*scale
+							x0, y0 := x/f[0]*w, y/f[1]*h
+							sum, count := 0, 0
+							for sy := y0; sy < min(y0+h, full.Dy()); sy++ {
+								for sx := x0; sx < min(x0+w, full.Dx()); sx++ {
+									sum += int(channels(want, sx, sy)[c])
+									count++
+								}
+							}
+							d := int(have[c]) - (sum+count/2)/count
+							if d < 0 {
+								d = -d
+							}
+							worst = max(worst, d)
+							total += d
+							n++
+						}
+					}
+				}
+				mean := float64(total) / float64(n)
+				if scale == 1 && worst > 0 {
+					t.Errorf("differs from image/jpeg by up to %d", worst)
+				}
+				if mean > maxMean[scale] {
+					t.Errorf("mean error %.2f, want at most %.1f", mean, maxMean[scale])
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkDecode compares decoding a 12 megapixel photo at a reduced scale
+// with decoding it at full size and then resizing it.
+func BenchmarkDecode(b *testing.B) {
+	src := smoothImage(4000, 3000)
+	// Noise, so the blocks have detail to decode
+	for i := range src.Pix {
+		src.Pix[i] += uint8(i * 7919 % 13)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, &jpeg.Options{Quality: 85}); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, scale := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("jpegscale/1:%d", scale), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(bytes.NewReader(data), scale); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("image-jpeg+resize/1:%d", scale), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				img, err := jpeg.Decode(bytes.NewReader(data))
+				if err != nil {
+					b.Fatal(err)
+				}
+				r := img.Bounds()
+				dst := image.NewRGBA(image.Rect(0, 0, (r.Dx()+scale-1)/scale, (r.Dy()+scale-1)/scale))
+				xdraw.ApproxBiLinear.Scale(dst, dst.Rect, img, r, xdraw.Src, nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+
+	"resizer/models"
+)
+
+// defaultLimits apply until the user changes them. 100 megapixels covers
+// any camera; a 50000x50000 bomb is 25 times that.
+var defaultLimits = models.Limits{
+	MaxPixels:     100_000_000,
+	MaxFileSize:   200 << 20,
+	MaxTaskMemory: 2 << 30,
+}
+
+// errLimitExceeded is wrapped by every resource limit failure.
+var errLimitExceeded = errors.New("resource limit exceeded")
+
+// checkFileSize rejects source files over the size limit.
+func checkFileSize(limits models.Limits, size int64) error {
+	if limits.MaxFileSize > 0 && size > limits.MaxFileSize {
+		return fmt.Errorf("%w: file is %s, the limit is %s", errLimitExceeded, formatBytes(size), formatBytes(limits.MaxFileSize))
+	}
+	return nil
+}
+
+// checkPixels rejects images whose header claims more pixels than the limit.
+// It runs on the result of inspectImage, before anything is decoded.
+func checkPixels(limits models.Limits, cfg image.Config) error {
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	if limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		return fmt.Errorf("%w: image is %dx%d (%.1f megapixels), the limit is %.1f megapixels",
+			errLimitExceeded, cfg.Width, cfg.Height, float64(pixels)/1e6, float64(limits.MaxPixels)/1e6)
+	}
+	return nil
+}
+
+// checkMemory rejects work whose estimated memory use is over the limit.
+func checkMemory(limits models.Limits, estimate int64) error {
+	if limits.MaxTaskMemory > 0 && estimate > limits.MaxTaskMemory {
+		return fmt.Errorf("%w: processing needs about %s of memory, the limit is %s",
+			errLimitExceeded, formatBytes(estimate), formatBytes(limits.MaxTaskMemory))
+	}
+	return nil
+}
+
+// sourceMemory estimates the bytes held by a decoded source: the decoded
+// pixels plus one working copy for orientation, colour conversion or
+// resampler input. A GIF keeps every frame as paletted pixels and renders
+// onto a full canvas. shrink is the JPEG decode scale.
+func sourceMemory(data []byte, format *imageFormat, cfg image.Config, shrink int) (int64, error) {
+	w, h := int64(cfg.Width), int64(cfg.Height)
+	if format.Name == "gif" {
+		frames, err := gifFrameCount(data)
+		if err != nil {
+			return 0, err
+		}
+		return int64(frames)*w*h + 4*w*h, nil
+	}
+
+	s := int64(shrink)
+	pixels := ((w + s - 1) / s) * ((h + s - 1) / s)
+	return 2 * pixels * bytesPerPixel(cfg.ColorModel), nil
+}
+
+// taskMemory estimates the peak memory of a task: the source plus the
+// largest output, resized and then encoded.
+func taskMemory(data []byte, format *imageFormat, cfg image.Config, shrink int, task *models.ImageTask) (int64, error) {
+	total, err := sourceMemory(data, format, cfg, shrink)
+	if err != nil {
+		return 0, err
+	}
+
+	frames := int64(1)
+	if format.Name == "gif" {
+		n, _ := gifFrameCount(data)
+		frames = int64(max(n, 1))
+	}
+	var largest int64
+	for _, target := range taskTargets(task) {
+		plan, err := planTarget(task, target, cfg.Width, cfg.Height)
+		if err != nil {
+			// writeOutput reports bad settings
+			continue
+		}
+		canvas := int64(plan.canvas.X) * int64(plan.canvas.Y)
+		largest = max(largest, 2*4*canvas, frames*canvas+4*canvas)
+	}
+	return total + largest, nil
+}
+
+// bytesPerPixel is the in-memory size of one decoded pixel, allowing for
+// conversion to NRGBA or NRGBA64.
+func bytesPerPixel(model color.Model) int64 {
+	switch model {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return 8
+	}
+	return 4
+}
+
+// formatBytes renders a byte count for error messages.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
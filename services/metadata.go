@@ -0,0 +1,431 @@
+package services
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"resizer/models"
+)
+
+// imageMetadata is the metadata carried from a source image to its outputs.
+// Go's encoders write bare pixels, so it is read from the source file and
+// spliced back into the encoded output.
+type imageMetadata struct {
+	exif     []byte     // TIFF-structured EXIF
+	xmp      []byte     // XMP packet
+	iptc     []byte     // Photoshop image resources (APP13), which hold IPTC
+	icc      []byte     // ICC colour profile
+	comments []string   // JPEG COM segments
+	pngText  []pngChunk // tEXt, zTXt, iTXt and tIME chunks of a PNG source
+}
+
+var (
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+	iptcHeader = []byte("Photoshop 3.0\x00")
+)
+
+const xmpKeyword = "XML:com.adobe.xmp"
+
+// Largest payloads that fit in one JPEG marker segment
+const (
+	jpegMaxSegment = 65533
+	iccChunkSize   = jpegMaxSegment - 14
+)
+
+func validateMetadataPolicy(policy string) error {
+	switch policy {
+	case models.MetadataKeep, models.MetadataStrip, models.MetadataStripPrivate:
+		return nil
+	}
+	return fmt.Errorf("unknown metadata policy %q", policy)
+}
+
+// metadataKept lists the kinds of metadata embed writes to each output
+// format. GIF stores none.
+var metadataKept = map[string][]string{
+	"jpeg": {"EXIF", "XMP", "IPTC", "ICC profile", "comments"},
+	"png":  {"EXIF", "XMP", "ICC profile", "comments", "PNG text"},
+	"webp": {"ICC profile"},
+}
+
+// lostIn lists the kinds of metadata in m that an output in format can't
+// store, so the policy can't keep them.
+func (m *imageMetadata) lostIn(format string) []string {
+	if m == nil {
+		return nil
+	}
+	present := []struct {
+		kind string
+		has  bool
+	}{
+		{"EXIF", m.exif != nil},
+		{"XMP", m.xmp != nil},
+		{"IPTC", m.iptc != nil},
+		{"ICC profile", m.icc != nil},
+		{"comments", len(m.comments) > 0},
+		{"PNG text", len(m.pngText) > 0},
+	}
+	var lost []string
+	for _, p := range present {
+		if !p.has {
+			continue
+		}
+		kept := false
+		for _, kind := range metadataKept[format] {
+			if kind == p.kind {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			lost = append(lost, p.kind)
+		}
+	}
+	return lost
+}
+
+// readMetadata collects the metadata of a JPEG, PNG or WebP file. Anything
+// malformed is skipped rather than failing the task.
+func readMetadata(data []byte, format *imageFormat) *imageMetadata {
+	m := &imageMetadata{exif: findEXIF(data, format)}
+	switch format.Name {
+	case "jpeg":
+		iccChunks := make(map[int][]byte)
+		for _, seg := range readJPEGSegments(data) {
+			switch {
+			case seg.marker == jpegMarkerAPP1 && bytes.HasPrefix(seg.data, xmpHeader):
+				m.xmp = seg.data[len(xmpHeader):]
+			case seg.marker == jpegMarkerAPP2 && bytes.HasPrefix(seg.data, iccHeader) && len(seg.data) > len(iccHeader)+2:
+				// Profiles larger than a segment are split into numbered chunks
+				iccChunks[int(seg.data[len(iccHeader)])] = seg.data[len(iccHeader)+2:]
+			case seg.marker == jpegMarkerAPP13 && bytes.HasPrefix(seg.data, iptcHeader):
+				m.iptc = seg.data[len(iptcHeader):]
+			case seg.marker == jpegMarkerCOM:
+				m.comments = append(m.comments, string(seg.data))
+			}
+		}
+		m.icc = joinICCChunks(iccChunks)
+	case "png":
+		for _, chunk := range readPNGChunks(data) {
+			switch chunk.typ {
+			case "iCCP":
+				if icc, err := readICCPChunk(chunk.data); err == nil {
+					m.icc = icc
+				}
+			case "iTXt":
+				if bytes.HasPrefix(chunk.data, []byte(xmpKeyword+"\x00")) {
+					if xmp, err := readITXtText(chunk.data); err == nil {
+						m.xmp = xmp
+					}
+					continue
+				}
+				m.pngText = append(m.pngText, chunk)
+			case "tEXt", "zTXt", "tIME":
+				m.pngText = append(m.pngText, chunk)
+			}
+		}
+	case "webp":
+		for _, chunk := range readWebPChunks(data) {
+			switch chunk.fourCC {
+			case "XMP ":
+				m.xmp = chunk.data
+			case "ICCP":
+				m.icc = chunk.data
+			}
+		}
+	}
+	return m
+}
+
+// joinICCChunks reassembles an ICC profile split across APP2 segments,
+// numbered from 1. A profile with missing chunks is dropped.
+func joinICCChunks(chunks map[int][]byte) []byte {
+	if len(chunks) == 0 {
+		return nil
+	}
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	var icc []byte
+	for n, seq := range seqs {
+		if seq != n+1 {
+			return nil
+		}
+		icc = append(icc, chunks[seq]...)
+	}
+	return icc
+}
+
+// readICCPChunk returns the profile in a PNG iCCP chunk: a name, a
+// compression method byte and zlib data.
+func readICCPChunk(data []byte) ([]byte, error) {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+2 > len(data) {
+		return nil, fmt.Errorf("invalid iCCP chunk")
+	}
+	return inflate(data[i+2:])
+}
+
+// readITXtText returns the text of a PNG iTXt chunk.
+func readITXtText(data []byte) ([]byte, error) {
+	// keyword, compression flag, compression method, language, translated keyword
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i+3 > len(data) {
+		return nil, fmt.Errorf("invalid iTXt chunk")
+	}
+	compressed := data[i+1] == 1
+	rest := data[i+3:]
+	for n := 0; n < 2; n++ {
+		j := bytes.IndexByte(rest, 0)
+		if j < 0 {
+			return nil, fmt.Errorf("invalid iTXt chunk")
+		}
+		rest = rest[j+1:]
+	}
+	if compressed {
+		return inflate(rest)
+	}
+	return rest, nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// applyPolicy removes the metadata the project's policy does not allow. The
+// colour profile is always kept: dropping it would change how the pixels
+// look, so it is not treated as metadata here.
+func (m *imageMetadata) applyPolicy(policy string) {
+	switch policy {
+	case models.MetadataStrip:
+		*m = imageMetadata{icc: m.icc}
+	case models.MetadataStripPrivate:
+		if m.exif != nil {
+			exif, err := parseEXIF(m.exif)
+			if err == nil {
+				err = exif.removeTags(exifPrivateTags)
+			}
+			if err != nil {
+				// Can't tell what is in it, so it can't be kept
+				log.Printf("Dropping unreadable EXIF: %v", err)
+				m.exif = nil
+			} else {
+				m.exif = exif.b
+			}
+		}
+		if m.xmp != nil {
+			m.xmp = scrubXMP(m.xmp)
+		}
+		// ImageMagick stores raw EXIF and XMP as hex in text chunks
+		text := m.pngText[:0]
+		for _, chunk := range m.pngText {
+			if !bytes.HasPrefix(chunk.data, []byte("Raw profile type ")) {
+				text = append(text, chunk)
+			}
+		}
+		m.pngText = text
+	}
+}
+
+// XMP properties that hold location, serial numbers or owner names, matched
+// by local name in any namespace
+var (
+	xmpPrivateNames     = `GPS\w*|SerialNumber|LensSerialNumber|BodySerialNumber|CameraSerialNumber|OwnerName|CameraOwnerName`
+	xmpPrivateAttribute = regexp.MustCompile(`\s[A-Za-z][\w.-]*:(?:` + xmpPrivateNames + `)\s*=\s*(?:"[^"]*"|'[^']*')`)
+	xmpPrivateElement   = regexp.MustCompile(`<([A-Za-z][\w.-]*:(?:` + xmpPrivateNames + `))[\s/>]`)
+)
+
+// scrubXMP removes private properties from an XMP packet, whether written
+// as attributes or as elements.
+func scrubXMP(xmp []byte) []byte {
+	out := xmpPrivateAttribute.ReplaceAll(xmp, nil)
+	for {
+		loc := xmpPrivateElement.FindSubmatchIndex(out)
+		if loc == nil {
+			return out
+		}
+		name := string(out[loc[2]:loc[3]])
+		tagEnd := bytes.IndexByte(out[loc[0]:], '>')
+		if tagEnd < 0 {
+			return out[:loc[0]]
+		}
+		end := loc[0] + tagEnd + 1
+		if out[end-2] != '/' {
+			closing := bytes.Index(out[end:], []byte("</"+name+">"))
+			if closing < 0 {
+				return out[:loc[0]]
+			}
+			end += closing + len(name) + 3
+		}
+		out = append(out[:loc[0]], out[end:]...)
+	}
+}
+
+// preparedEXIF returns a copy of the EXIF data that matches the output: the
+// pixels were already turned upright, and the size has changed.
+func (m *imageMetadata) preparedEXIF(width, height int) []byte {
+	exif, err := parseEXIF(m.exif)
+	if err == nil {
+		err = exif.setInt(exifTagOrientation, orientationNormal)
+	}
+	if err == nil {
+		err = exif.setInt(exifTagPixelXDimension, width)
+	}
+	if err == nil {
+		err = exif.setInt(exifTagPixelYDimension, height)
+	}
+	if err != nil {
+		log.Printf("Dropping unreadable EXIF: %v", err)
+		return nil
+	}
+	return exif.b
+}
+
+// embed writes the metadata into an encoded JPEG or PNG. WebP outputs only
+// get the colour profile; other formats are returned unchanged.
+func (m *imageMetadata) embed(data []byte, format *imageFormat, width, height int) []byte {
+	if m == nil {
+		return data
+	}
+	var exif []byte
+	if m.exif != nil {
+		exif = m.preparedEXIF(width, height)
+	}
+
+	switch format.Name {
+	case "jpeg":
+		var segments bytes.Buffer
+		if exif != nil {
+			writeJPEGSegment(&segments, jpegMarkerAPP1, exifHeader, exif)
+		}
+		if m.xmp != nil {
+			writeJPEGSegment(&segments, jpegMarkerAPP1, xmpHeader, m.xmp)
+		}
+		if m.icc != nil {
+			total := (len(m.icc) + iccChunkSize - 1) / iccChunkSize
+			if total > 255 {
+				log.Printf("Dropping ICC profile of %d bytes: too large for JPEG", len(m.icc))
+			}
+			for n := 0; n < total && total <= 255; n++ {
+				chunk := m.icc[n*iccChunkSize : min(len(m.icc), (n+1)*iccChunkSize)]
+				header := append(append([]byte(nil), iccHeader...), byte(n+1), byte(total))
+				writeJPEGSegment(&segments, jpegMarkerAPP2, header, chunk)
+			}
+		}
+		if m.iptc != nil {
+			writeJPEGSegment(&segments, jpegMarkerAPP13, iptcHeader, m.iptc)
+		}
+		for _, comment := range m.comments {
+			writeJPEGSegment(&segments, jpegMarkerCOM, nil, []byte(comment))
+		}
+		// Letak lepas SOI
+		return append(append(data[:2:2], segments.Bytes()...), data[2:]...)
+
+	case "png":
+		var chunks bytes.Buffer
+		if m.icc != nil {
+			var compressed bytes.Buffer
+			zw := zlib.NewWriter(&compressed)
+			zw.Write(m.icc)
+			zw.Close()
+			writePNGChunk(&chunks, "iCCP", append([]byte("ICC Profile\x00\x00"), compressed.Bytes()...))
+		}
+		if exif != nil {
+			writePNGChunk(&chunks, "eXIf", exif)
+		}
+		if m.xmp != nil {
+			writePNGChunk(&chunks, "iTXt", append([]byte(xmpKeyword+"\x00\x00\x00\x00\x00"), m.xmp...))
+		}
+		for _, chunk := range m.pngText {
+			writePNGChunk(&chunks, chunk.typ, chunk.data)
+		}
+		for _, comment := range m.comments {
+			writePNGChunk(&chunks, "tEXt", []byte("Comment\x00"+strings.ToValidUTF8(comment, "")))
+		}
+		if m.iptc != nil {
+			log.Printf("IPTC metadata is not written to PNG outputs")
+		}
+		// IHDR is always the first chunk; everything above may follow it
+		ihdrEnd := len(pngSignature) + 12 + 13
+		if len(data) < ihdrEnd {
+			return data
+		}
+		return append(append(data[:ihdrEnd:ihdrEnd], chunks.Bytes()...), data[ihdrEnd:]...)
+
+	case "webp":
+		if m.icc != nil {
+			return embedWebPICC(data, m.icc, width, height)
+		}
+	}
+	return data
+}
+
+// embedWebPICC adds an ICCP chunk to an encoded WebP, which needs the
+// extended (VP8X) container.
+func embedWebPICC(data, icc []byte, width, height int) []byte {
+	chunks := readWebPChunks(data)
+	if len(chunks) == 0 {
+		return data
+	}
+	var vp8x []byte
+	if chunks[0].fourCC == "VP8X" {
+		vp8x = append([]byte(nil), chunks[0].data...)
+		chunks = chunks[1:]
+	} else {
+		vp8x = make([]byte, 10)
+		putUint24(vp8x[4:], uint32(width-1))
+		putUint24(vp8x[7:], uint32(height-1))
+	}
+	vp8x[0] |= 0x20 // ICC flag
+
+	// ICCP comes straight after VP8X
+	body := append([]byte("WEBP"), webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("ICCP", icc)...)
+	for _, chunk := range chunks {
+		body = append(body, webpChunk(chunk.fourCC, chunk.data)...)
+	}
+	header := make([]byte, 8)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(body)))
+	return append(header, body...)
+}
+
+// writeJPEGSegment writes a marker segment, skipping payloads too large for
+// one segment.
+func writeJPEGSegment(w *bytes.Buffer, marker byte, header, payload []byte) {
+	n := len(header) + len(payload)
+	if n > jpegMaxSegment {
+		log.Printf("Dropping %d-byte JPEG segment %#02x: too large", n, marker)
+		return
+	}
+	w.Write([]byte{0xff, marker})
+	binary.Write(w, binary.BigEndian, uint16(n+2))
+	w.Write(header)
+	w.Write(payload)
+}
+
+func writePNGChunk(w *bytes.Buffer, typ string, data []byte) {
+	binary.Write(w, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data)
+	w.WriteString(typ)
+	w.Write(data)
+	binary.Write(w, binary.BigEndian, crc.Sum32())
+}
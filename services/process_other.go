@@ -0,0 +1,12 @@
+//go:build !windows
+
+package services
+
+import "syscall"
+
+// processAlive reports whether a process with the given ID is running.
+func processAlive(pid int) bool {
+	// Signal 0 only checks that the process exists
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package services
+
+import "syscall"
+
+// stillActive is the exit code GetExitCodeProcess reports for a process
+// that hasn't exited.
+const stillActive = 259
+
+// processAlive reports whether a process with the given ID is running.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Someone else's process still exists
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
@@ -50,16 +50,20 @@ func (p *ProjectService) CreateProject(name, description string) (*models.Projec
 	}
 
 	project := &models.Project{
-		Name:         name,
-		Description:  description,
-		CreationTime: time.Now(),
-		Location:     location,
+		Name:           name,
+		Description:    description,
+		CreationTime:   time.Now(),
+		Location:       location,
+		MetadataPolicy: models.MetadataKeep,
+		RetryPolicy:    defaultRetryPolicy,
 	}
 
 	result, err := p.db.Exec(`
-		INSERT INTO projects (name, description, creation_time, location)
-		VALUES (?, ?, ?, ?)
-	`, project.Name, project.Description, project.CreationTime, project.Location)
+		INSERT INTO projects (name, description, creation_time, location, metadata_policy,
+			max_attempts, retry_delay, max_retry_delay)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, project.Name, project.Description, project.CreationTime, project.Location, project.MetadataPolicy,
+		project.MaxAttempts, project.RetryDelay, project.MaxRetryDelay)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create project: %w", err)
@@ -77,7 +81,9 @@ func (p *ProjectService) CreateProject(name, description string) (*models.Projec
 func (p *ProjectService) GetProject(id int64) (*models.Project, error) {
 	project := &models.Project{}
 	err := p.db.QueryRow(`
-		SELECT id, name, description, creation_time, location
+		SELECT id, name, description, creation_time, location, metadata_policy,
+			jpeg_quality, png_compression, webp_quality, webp_mode,
+			max_attempts, retry_delay, max_retry_delay
 		FROM projects WHERE id = ?
 	`, id).Scan(
 		&project.ID,
@@ -85,6 +91,14 @@ func (p *ProjectService) GetProject(id int64) (*models.Project, error) {
 		&project.Description,
 		&project.CreationTime,
 		&project.Location,
+		&project.MetadataPolicy,
+		&project.JPEGQuality,
+		&project.PNGCompression,
+		&project.WebPQuality,
+		&project.WebPMode,
+		&project.MaxAttempts,
+		&project.RetryDelay,
+		&project.MaxRetryDelay,
 	)
 
 	if err == sql.ErrNoRows {
@@ -99,7 +113,9 @@ func (p *ProjectService) GetProject(id int64) (*models.Project, error) {
 
 func (p *ProjectService) ListProjects() ([]models.Project, error) {
 	rows, err := p.db.Query(`
-		SELECT id, name, description, creation_time, location
+		SELECT id, name, description, creation_time, location, metadata_policy,
+			jpeg_quality, png_compression, webp_quality, webp_mode,
+			max_attempts, retry_delay, max_retry_delay
 		FROM projects ORDER BY creation_time DESC
 	`)
 	if err != nil {
@@ -116,6 +132,14 @@ func (p *ProjectService) ListProjects() ([]models.Project, error) {
 			&project.Description,
 			&project.CreationTime,
 			&project.Location,
+			&project.MetadataPolicy,
+			&project.JPEGQuality,
+			&project.PNGCompression,
+			&project.WebPQuality,
+			&project.WebPMode,
+			&project.MaxAttempts,
+			&project.RetryDelay,
+			&project.MaxRetryDelay,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan project: %w", err)
@@ -127,11 +151,31 @@ func (p *ProjectService) ListProjects() ([]models.Project, error) {
 }
 
 func (p *ProjectService) UpdateProject(project *models.Project) error {
+	// Encoder settings here are the defaults for new tasks in the project
+	if err := validateEncoderSettings(project.EncoderSettings); err != nil {
+		return err
+	}
+	if project.MetadataPolicy == "" {
+		project.MetadataPolicy = models.MetadataKeep
+	}
+	if err := validateMetadataPolicy(project.MetadataPolicy); err != nil {
+		return err
+	}
+	project.RetryPolicy = withRetryDefaults(project.RetryPolicy)
+	if err := validateRetryPolicy(project.RetryPolicy); err != nil {
+		return err
+	}
+
 	_, err := p.db.Exec(`
 		UPDATE projects 
-		SET name = ?, description = ?
+		SET name = ?, description = ?, metadata_policy = ?,
+			jpeg_quality = ?, png_compression = ?, webp_quality = ?, webp_mode = ?,
+			max_attempts = ?, retry_delay = ?, max_retry_delay = ?
 		WHERE id = ?
-	`, project.Name, project.Description, project.ID)
+	`, project.Name, project.Description, project.MetadataPolicy,
+		project.JPEGQuality, project.PNGCompression, project.WebPQuality, project.WebPMode,
+		project.MaxAttempts, project.RetryDelay, project.MaxRetryDelay,
+		project.ID)
 
 	if err != nil {
 		return fmt.Errorf("failed to update project: %w", err)
@@ -155,7 +199,22 @@ func (p *ProjectService) DeleteProject(id int64) error {
 		return fmt.Errorf("failed to get project location: %w", err)
 	}
 
-	// Buang image tasks sebab foreign key constraint
+	// Buang task outputs, events dan image tasks sebab foreign key constraint
+	_, err = tx.Exec("DELETE FROM task_outputs WHERE task_id IN (SELECT id FROM image_tasks WHERE project_id = ?)", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete project task outputs: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM task_events WHERE task_id IN (SELECT id FROM image_tasks WHERE project_id = ?)", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete project task events: %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM schedules WHERE project_id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete project schedules: %w", err)
+	}
+
 	_, err = tx.Exec("DELETE FROM image_tasks WHERE project_id = ?", id)
 	if err != nil {
 		return fmt.Errorf("failed to delete project image tasks: %w", err)
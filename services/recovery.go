@@ -0,0 +1,266 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"resizer/models"
+)
+
+// tempSuffix marks an output file that is still being written. Outputs are
+// renamed into place once complete, so a crash leaves only temp files half
+// written.
+const tempSuffix = ".tmp-"
+
+// renditionSuffix matches the size a rendition adds to the output name.
+var renditionSuffix = regexp.MustCompile(`^-\d+x\d+$`)
+
+// writeFileAtomic writes data to path through a temp file in the same
+// directory, so path is either absent, the old file or the complete new one.
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	tmp, err := os.CreateTemp(dir, "."+name+tempSuffix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// RecoverOrphanedTasks deals with tasks left processing by an app instance
+// that quit or crashed, found by their lapsed lease or, for instances on
+// this machine, because their process is gone, so a restart doesn't have to
+// wait out the lease. Each one is claimed first so only one instance
+// recovers it, its partial outputs are removed, and it is requeued or failed
+// according to the orphan policy. Requeued tasks still count the interrupted
+// run against the project's max attempts. It returns the number of tasks
+// recovered.
+func (i *ImageService) RecoverOrphanedTasks() (int, error) {
+	policy, err := loadOrphanPolicy(i.db)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	rows, err := i.db.Query(`
+		SELECT `+taskColumns+`
+		FROM image_tasks
+		WHERE status = ?
+	`, models.TaskProcessing)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find orphaned tasks: %w", err)
+	}
+	var orphans []models.ImageTask
+	for rows.Next() {
+		var task models.ImageTask
+		if err := scanTask(rows, &task); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan task: %w", err)
+		}
+		if task.LeaseExpires.Unix() < now.Unix() || i.ownerGone(task.ClaimedBy) {
+			orphans = append(orphans, task)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to find orphaned tasks: %w", err)
+	}
+
+	recovered := 0
+	for _, task := range orphans {
+		ok, err := i.recoverTask(&task, policy)
+		if err != nil {
+			log.Printf("Error recovering task %d: %v", task.ID, err)
+			continue
+		}
+		if ok {
+			recovered++
+		}
+	}
+	return recovered, nil
+}
+
+// recoverTask recovers one orphaned task. It returns false if another
+// instance recovered it first, or its owner renewed the lease meanwhile.
+func (i *ImageService) recoverTask(task *models.ImageTask, policy string) (bool, error) {
+	now := time.Now()
+	// A gone owner can't renew its lease, so it is enough that the task
+	// still has that owner
+	orphaned, arg := "lease_expires < ?", interface{}(now.Unix())
+	if i.ownerGone(task.ClaimedBy) {
+		orphaned, arg = "claimed_by = ?", task.ClaimedBy
+	}
+	result, err := i.db.Exec(`
+		UPDATE image_tasks SET claimed_by = ?, lease_expires = ?
+		WHERE id = ? AND status = ? AND `+orphaned,
+		i.owner, now.Add(leaseDuration).Unix(), task.ID, models.TaskProcessing, arg)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim orphaned task: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	// A task that keeps taking the app down with it shouldn't run forever
+	retry, err := loadRetryPolicy(i.db, task.ProjectID)
+	if err != nil {
+		return false, err
+	}
+	status, reason, action := models.TaskPending, "", "requeueing"
+	switch {
+	case policy == models.OrphanFail:
+		status, reason, action = models.TaskFailed, "processing was interrupted: the app quit or crashed", "failing"
+	case task.AttemptCount >= retry.MaxAttempts:
+		status, action = models.TaskFailed, "failing"
+		reason = fmt.Sprintf("processing was interrupted %d times: the app quit or crashed", task.AttemptCount)
+	}
+	previousOwner := task.ClaimedBy
+	if previousOwner == "" {
+		previousOwner = "an earlier version of the app"
+	}
+	log.Printf("Task %d was left processing by %s, %s it", task.ID, previousOwner, action)
+
+	if err := i.removePartialOutputs(task); err != nil {
+		return false, err
+	}
+
+	message := "left processing by " + previousOwner
+	if reason != "" {
+		message = reason
+	}
+	_, err = i.transitionTask(task.ID, taskChange{
+		action: "recover",
+		from:   []models.TaskStatus{models.TaskProcessing},
+		to:     status,
+		set: `last_error = ?, error_stack = '', claimed_by = '', lease_expires = 0,
+			output_path = '', output_width = 0, output_height = 0, output_size = 0`,
+		setArgs:   []interface{}{reason},
+		where:     "claimed_by = ?",
+		whereArgs: []interface{}{i.owner},
+		actor:     i.owner,
+		message:   message,
+		// Earlier outputs of the task may have been overwritten half way, so
+		// they go too
+		within: func(tx *sql.Tx) error {
+			if _, err := tx.Exec("DELETE FROM task_outputs WHERE task_id = ?", task.ID); err != nil {
+				return fmt.Errorf("failed to clear task outputs: %w", err)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to update task status: %w", err)
+	}
+	return true, nil
+}
+
+// ownerGone reports whether owner, an ID from newOwnerID, belongs to a
+// process on this machine that has exited. Owners on other machines can't
+// be checked, so they are left to their leases.
+func (i *ImageService) ownerGone(owner string) bool {
+	fields := strings.Split(owner, ":")
+	if owner == i.owner || len(fields) < 3 {
+		return false
+	}
+	host, err := os.Hostname()
+	if err != nil || strings.Join(fields[:len(fields)-2], ":") != host {
+		return false
+	}
+	pid, err := strconv.Atoi(fields[len(fields)-2])
+	if err != nil {
+		return false
+	}
+	// Our own process ID in another owner ID was an earlier process that
+	// has exited, its ID since reused for this one
+	return pid == os.Getpid() || !processAlive(pid)
+}
+
+// removePartialOutputs deletes the files an interrupted run of task may
+// have left in the resized folder: its temp files, and outputs that no
+// other task has recorded as its own.
+func (i *ImageService) removePartialOutputs(task *models.ImageTask) error {
+	dir := filepath.Join(filepath.Dir(filepath.Dir(task.ImagePath)), "resized")
+	base := strings.TrimSuffix(filepath.Base(task.ImagePath), filepath.Ext(task.ImagePath))
+	base = fmt.Sprintf("%s-%d", base, task.ID)
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read output directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		temp := false
+		if at := strings.Index(name, tempSuffix); strings.HasPrefix(name, ".") && at > 0 {
+			name, temp = name[1:at], true
+		}
+		if !isTaskOutputName(name, base) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		if !temp {
+			var owners int
+			err := i.db.QueryRow(`
+				SELECT (SELECT COUNT(*) FROM task_outputs WHERE path = ? AND task_id != ?)
+					+ (SELECT COUNT(*) FROM image_tasks WHERE output_path = ? AND id != ?)
+			`, path, task.ID, path, task.ID).Scan(&owners)
+			if err != nil {
+				return fmt.Errorf("failed to check output owners: %w", err)
+			}
+			if owners > 0 {
+				continue
+			}
+		}
+
+		log.Printf("Removing partial output %s", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove partial output: %w", err)
+		}
+	}
+	return nil
+}
+
+// isTaskOutputName reports whether name is an output file named base, the
+// source's name and task ID: base itself or a base-WxH rendition, with an
+// output format's extension.
+func isTaskOutputName(name, base string) bool {
+	ext := filepath.Ext(name)
+	known := false
+	for _, f := range imageFormats {
+		if f.Extensions[0] == ext {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return false
+	}
+	stem := strings.TrimSuffix(name, ext)
+	if stem == base {
+		return true
+	}
+	return strings.HasPrefix(stem, base) && renditionSuffix.MatchString(stem[len(base):])
+}
@@ -0,0 +1,469 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"resizer/models"
+)
+
+// Resampler scales an image to a new size. Implementations must be safe for
+// concurrent use; one value is shared by every task that selects it.
+type Resampler interface {
+	Resize(src image.Image, width, height int, opts ResampleOptions) image.Image
+}
+
+// ResampleOptions are the per-task settings a Resampler must honour.
+type ResampleOptions struct {
+	// LinearLight blends pixels in linear light instead of sRGB, which keeps
+	// fine bright detail on dark backgrounds from darkening when downscaled
+	LinearLight bool
+	// Context, if set, stops the resize early when it's cancelled. What
+	// Resize returns then is incomplete, so callers check Context.Err()
+	Context context.Context
+}
+
+var (
+	resamplersMu sync.RWMutex
+	resamplers   = map[string]Resampler{
+		models.ResamplerNearest:    nearestResampler{},
+		models.ResamplerBox:        NewKernelResampler(0.5, boxKernel),
+		models.ResamplerBilinear:   NewKernelResampler(1, triangleKernel),
+		models.ResamplerCatmullRom: NewKernelResampler(2, cubicKernel(0, 0.5)),
+		models.ResamplerMitchell:   NewKernelResampler(2, cubicKernel(1.0/3, 1.0/3)),
+		models.ResamplerLanczos2:   NewKernelResampler(2, lanczosKernel(2)),
+		models.ResamplerLanczos3:   NewKernelResampler(3, lanczosKernel(3)),
+	}
+)
+
+// RegisterResampler makes r selectable by name on tasks, replacing any
+// resampler already registered under that name.
+func RegisterResampler(name string, r Resampler) {
+	resamplersMu.Lock()
+	defer resamplersMu.Unlock()
+	resamplers[name] = r
+}
+
+// resamplerByName returns the named resampler, or nil if there is none.
+func resamplerByName(name string) Resampler {
+	resamplersMu.RLock()
+	defer resamplersMu.RUnlock()
+	return resamplers[name]
+}
+
+// ResamplerNames lists the registered resamplers.
+func ResamplerNames() []string {
+	resamplersMu.RLock()
+	defer resamplersMu.RUnlock()
+	names := make([]string, 0, len(resamplers))
+	for name := range resamplers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// kernelResampler is a separable convolution: each output pixel is a
+// weighted sum of the source pixels under the kernel, along rows and then
+// along columns. When downscaling the kernel is stretched to cover the
+// source pixels that fold into one output pixel, which is what makes box an
+// area average.
+type kernelResampler struct {
+	support float64
+	kernel  func(x float64) float64
+}
+
+// NewKernelResampler returns a Resampler for a symmetric kernel that is zero
+// outside [-support, support].
+func NewKernelResampler(support float64, kernel func(x float64) float64) Resampler {
+	return &kernelResampler{support: support, kernel: kernel}
+}
+
+func (k *kernelResampler) Resize(src image.Image, width, height int, opts ResampleOptions) image.Image {
+	b := src.Bounds()
+	return resample(src, width, height, k.weights(b.Dx(), width), k.weights(b.Dy(), height), opts)
+}
+
+// weights computes the taps of every output pixel along one axis. Taps past
+// the edge are clamped to the edge pixel.
+func (k *kernelResampler) weights(srcLen, dstLen int) *axisWeights {
+	if srcLen == dstLen {
+		// Copy the axis as is; kernels that don't interpolate, like
+		// Mitchell, would otherwise blur it
+		return nearestWeights(srcLen, dstLen)
+	}
+	scale := float64(srcLen) / float64(dstLen)
+	stretch := math.Max(scale, 1)
+	radius := k.support * stretch
+
+	w := &axisWeights{start: make([]int, dstLen), offset: make([]int, dstLen+1)}
+	for i := 0; i < dstLen; i++ {
+		center := (float64(i)+0.5)*scale - 0.5
+		left := int(math.Ceil(center - radius))
+		right := int(math.Floor(center + radius))
+
+		first := len(w.taps)
+		start := -1
+		var sum float64
+		for j := left; j <= right; j++ {
+			v := k.kernel((float64(j) - center) / stretch)
+			if v == 0 {
+				continue
+			}
+			idx := min(max(j, 0), srcLen-1)
+			if start < 0 {
+				start = idx
+			}
+			// Clamped indices never decrease, so the taps stay contiguous
+			for first+idx-start >= len(w.taps) {
+				w.taps = append(w.taps, 0)
+			}
+			w.taps[first+idx-start] += float32(v)
+			sum += v
+		}
+		if start < 0 {
+			// The kernel missed every pixel; fall back to the nearest one
+			start = min(max(int(center+0.5), 0), srcLen-1)
+			w.taps = append(w.taps, 1)
+			sum = 1
+		}
+		for t := first; t < len(w.taps); t++ {
+			w.taps[t] /= float32(sum)
+		}
+		w.start[i] = start
+		w.offset[i+1] = len(w.taps)
+	}
+	return w
+}
+
+// nearestResampler copies the source pixel under each output pixel, for
+// pixel art that must stay sharp.
+type nearestResampler struct{}
+
+func (nearestResampler) Resize(src image.Image, width, height int, opts ResampleOptions) image.Image {
+	b := src.Bounds()
+	return resample(src, width, height, nearestWeights(b.Dx(), width), nearestWeights(b.Dy(), height), opts)
+}
+
+func nearestWeights(srcLen, dstLen int) *axisWeights {
+	w := &axisWeights{start: make([]int, dstLen), offset: make([]int, dstLen+1), taps: make([]float32, dstLen)}
+	for i := 0; i < dstLen; i++ {
+		w.start[i] = min(int((float64(i)+0.5)*float64(srcLen)/float64(dstLen)), srcLen-1)
+		w.offset[i+1] = i + 1
+		w.taps[i] = 1
+	}
+	return w
+}
+
+func boxKernel(x float64) float64 {
+	if x >= -0.5 && x < 0.5 {
+		return 1
+	}
+	return 0
+}
+
+func triangleKernel(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return 1 - x
+	}
+	return 0
+}
+
+// cubicKernel is the Mitchell-Netravali family: B=0, C=0.5 is Catmull-Rom
+// and B=C=1/3 is Mitchell.
+func cubicKernel(b, c float64) func(float64) float64 {
+	return func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x < 1:
+			return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+		case x < 2:
+			return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6
+		}
+		return 0
+	}
+}
+
+func lanczosKernel(lobes float64) func(float64) float64 {
+	return func(x float64) float64 {
+		if x > -lobes && x < lobes {
+			return sinc(x) * sinc(x/lobes)
+		}
+		return 0
+	}
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// axisWeights holds the taps of every output pixel along one axis: output
+// pixel i reads source pixels start[i], start[i]+1, ... weighted by
+// taps[offset[i]:offset[i+1]].
+type axisWeights struct {
+	start  []int
+	offset []int
+	taps   []float32
+}
+
+// maxTaps returns the widest tap run.
+func (w *axisWeights) maxTaps() int {
+	n := 0
+	for i := range w.start {
+		n = max(n, w.offset[i+1]-w.offset[i])
+	}
+	return n
+}
+
+// resample scales src with separable weights. It walks the output rows
+// keeping only the horizontally resampled source rows that the current
+// vertical taps need, so memory stays proportional to the output width.
+// Large images are split into bands of output rows spread across
+// GOMAXPROCS; every row is computed the same way whichever band it lands
+// in, so the result is byte-identical to a serial run.
+func resample(src image.Image, width, height int, xw, yw *axisWeights, opts ResampleOptions) image.Image {
+	return resampleWorkers(src, width, height, xw, yw, opts, runtime.GOMAXPROCS(0))
+}
+
+// Banding thresholds
+const (
+	resampleMinBandRows = 16
+	resampleBandsPerCPU = 4 // extra bands even out uneven progress
+)
+
+// resampleParallelWork is the number of taps (horizontal plus vertical)
+// below which a second goroutine costs more than it saves.
+var resampleParallelWork = 1 << 20
+
+func resampleWorkers(src image.Image, width, height int, xw, yw *axisWeights, opts ResampleOptions, workers int) image.Image {
+	if width <= 0 || height <= 0 {
+		panic(fmt.Sprintf("resample: invalid size %dx%d", width, height))
+	}
+	job := &resampleJob{xw: xw, yw: yw, window: yw.maxTaps(), srcW: src.Bounds().Dx(), width: width}
+	if opts.LinearLight {
+		job.transfer = srgbTransfer()
+	}
+	if opts.Context != nil {
+		job.done = opts.Context.Done()
+	}
+	job.read = newRowReader(src)
+	dst, write := newRowWriter(src, width, height, job.transfer)
+	job.write = write
+
+	work := len(xw.taps)*src.Bounds().Dy() + len(yw.taps)*width
+	bands := min(workers*resampleBandsPerCPU, height/resampleMinBandRows)
+	if workers <= 1 || bands <= 1 || work < resampleParallelWork {
+		job.rows(0, height)
+		return dst
+	}
+
+	var (
+		wg      sync.WaitGroup
+		next    atomic.Int64
+		panicMu sync.Mutex
+		failure *bandPanic
+	)
+	bandRows := (height + bands - 1) / bands
+	for w := 0; w < min(workers, bands); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				// Nothing can recover a panic on this goroutine, so hand it
+				// to the caller
+				if v := recover(); v != nil {
+					panicMu.Lock()
+					if failure == nil {
+						failure = &bandPanic{value: v, stack: debug.Stack()}
+					}
+					panicMu.Unlock()
+				}
+			}()
+			for {
+				y0 := int(next.Add(1)-1) * bandRows
+				if y0 >= height {
+					return
+				}
+				job.rows(y0, min(y0+bandRows, height))
+			}
+		}()
+	}
+	wg.Wait()
+	if failure != nil {
+		panic(failure)
+	}
+	return dst
+}
+
+// bandPanic is a panic raised on a band goroutine and re-raised by the
+// goroutine that called Resize, with the stack where it happened.
+type bandPanic struct {
+	value interface{}
+	stack []byte
+}
+
+func (p *bandPanic) String() string {
+	return fmt.Sprint(p.value)
+}
+
+// resampleJob is one resize, shared by the goroutines working on its bands.
+type resampleJob struct {
+	read     func(y int, row []uint16)
+	write    func(y int, row []float32)
+	xw, yw   *axisWeights
+	transfer *linearTransfer
+	done     <-chan struct{} // closed when the resize should stop
+	window   int             // most source rows one output row reads
+	srcW     int
+	width    int
+}
+
+// resampleScratch holds the row buffers of one band.
+type resampleScratch struct {
+	raw   []uint16
+	line  []float32
+	out   []float32
+	slots [][]float32
+	held  []int // source row in each slot
+}
+
+// resampleScratchPool keeps row buffers between bands and between resizes,
+// so renditions and GIF frames don't allocate their buffers again.
+var resampleScratchPool = sync.Pool{New: func() any { return new(resampleScratch) }}
+
+// grow resizes the buffers for a job, reusing their capacity.
+func (s *resampleScratch) grow(srcW, width, window int) {
+	s.raw = growSlice(s.raw, 4*srcW)
+	s.line = growSlice(s.line, 4*srcW)
+	s.out = growSlice(s.out, 4*width)
+	s.held = growSlice(s.held, window)
+	for len(s.slots) < window {
+		s.slots = append(s.slots, nil)
+	}
+	s.slots = s.slots[:window]
+	for i := range s.slots {
+		s.slots[i] = growSlice(s.slots[i], 4*width)
+		s.held[i] = -1
+	}
+}
+
+func growSlice[T any](s []T, n int) []T {
+	if cap(s) < n {
+		return make([]T, n)
+	}
+	return s[:n]
+}
+
+// rows computes output rows y0 to y1, or stops part way once done is
+// closed.
+func (j *resampleJob) rows(y0, y1 int) {
+	s := resampleScratchPool.Get().(*resampleScratch)
+	defer resampleScratchPool.Put(s)
+	window := j.window
+	s.grow(j.srcW, j.width, window)
+
+	for y := y0; y < y1; y++ {
+		select {
+		case <-j.done:
+			return
+		default:
+		}
+		start := j.yw.start[y]
+		taps := j.yw.taps[j.yw.offset[y]:j.yw.offset[y+1]]
+		for t := range taps {
+			sy := start + t
+			slot := sy % window
+			if s.held[slot] == sy {
+				continue
+			}
+			j.read(sy, s.raw)
+			premultiply(s.raw, s.line, j.transfer)
+			resampleRow(s.line, s.slots[slot], j.xw)
+			s.held[slot] = sy
+		}
+
+		clear(s.out)
+		for t, weight := range taps {
+			row := s.slots[(start+t)%window]
+			for i, v := range row {
+				s.out[i] += v * weight
+			}
+		}
+		j.write(y, s.out)
+	}
+}
+
+// resampleRow applies the horizontal taps to one premultiplied row.
+func resampleRow(src, dst []float32, xw *axisWeights) {
+	for x := range xw.start {
+		var r, g, b, a float32
+		p := 4 * xw.start[x]
+		for _, weight := range xw.taps[xw.offset[x]:xw.offset[x+1]] {
+			r += src[p] * weight
+			g += src[p+1] * weight
+			b += src[p+2] * weight
+			a += src[p+3] * weight
+			p += 4
+		}
+		dst[4*x], dst[4*x+1], dst[4*x+2], dst[4*x+3] = r, g, b, a
+	}
+}
+
+// premultiply turns a row of straight 16-bit RGBA into premultiplied values
+// in [0, 1], so transparent pixels don't bleed their colour into the result.
+// With a transfer the colour is made linear first; alpha is always linear.
+func premultiply(raw []uint16, row []float32, transfer *linearTransfer) {
+	for i := 0; i < len(raw); i += 4 {
+		a := float32(raw[i+3]) / 0xffff
+		if transfer != nil {
+			row[i] = transfer.toLinear[raw[i]] * a
+			row[i+1] = transfer.toLinear[raw[i+1]] * a
+			row[i+2] = transfer.toLinear[raw[i+2]] * a
+		} else {
+			row[i] = float32(raw[i]) / 0xffff * a
+			row[i+1] = float32(raw[i+1]) / 0xffff * a
+			row[i+2] = float32(raw[i+2]) / 0xffff * a
+		}
+		row[i+3] = a
+	}
+}
+
+// linearTransfer holds lookup tables between 16-bit sRGB and linear light.
+type linearTransfer struct {
+	toLinear [0x10000]float32 // indexed by the sRGB value
+	toSRGB   [0x10000]float32 // indexed by the linear value scaled to 16 bits
+}
+
+var (
+	srgbTransferOnce  sync.Once
+	srgbTransferTable *linearTransfer
+)
+
+func srgbTransfer() *linearTransfer {
+	srgbTransferOnce.Do(func() {
+		t := &linearTransfer{}
+		for i := range t.toLinear {
+			t.toLinear[i] = float32(srgbDecode(float64(i) / 0xffff))
+			t.toSRGB[i] = float32(srgbEncode(float64(i) / 0xffff))
+		}
+		srgbTransferTable = t
+	})
+	return srgbTransferTable
+}
+
+// encode maps a linear value in [0, 1] back to sRGB.
+func (t *linearTransfer) encode(v float32) float32 {
+	return t.toSRGB[int(v*0xffff+0.5)]
+}
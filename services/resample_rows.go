@@ -0,0 +1,192 @@
+package services
+
+import (
+	"image"
+	"image/color"
+)
+
+// newRowReader returns a function that reads source row y (counted from the
+// top of the bounds) as straight, non-premultiplied 16-bit RGBA. The common
+// decoder outputs are read directly; anything else goes through At.
+func newRowReader(src image.Image) func(y int, row []uint16) {
+	b := src.Bounds()
+	w := b.Dx()
+	switch img := src.(type) {
+	case *image.NRGBA:
+		return func(y int, row []uint16) {
+			pix := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for i := range row[:4*w] {
+				row[i] = uint16(pix[i]) * 0x101
+			}
+		}
+	case *image.RGBA:
+		return func(y int, row []uint16) {
+			pix := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for i := 0; i < 4*w; i += 4 {
+				unpremultiply16(row[i:i+4], uint32(pix[i])*0x101, uint32(pix[i+1])*0x101, uint32(pix[i+2])*0x101, uint32(pix[i+3])*0x101)
+			}
+		}
+	case *image.NRGBA64:
+		return func(y int, row []uint16) {
+			pix := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for i := range row[:4*w] {
+				row[i] = uint16(pix[2*i])<<8 | uint16(pix[2*i+1])
+			}
+		}
+	case *image.RGBA64:
+		return func(y int, row []uint16) {
+			pix := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for i := 0; i < 4*w; i += 4 {
+				c := func(n int) uint32 { return uint32(pix[2*(i+n)])<<8 | uint32(pix[2*(i+n)+1]) }
+				unpremultiply16(row[i:i+4], c(0), c(1), c(2), c(3))
+			}
+		}
+	case *image.Gray:
+		return func(y int, row []uint16) {
+			pix := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				v := uint16(pix[x]) * 0x101
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = v, v, v, 0xffff
+			}
+		}
+	case *image.Gray16:
+		return func(y int, row []uint16) {
+			pix := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				v := uint16(pix[2*x])<<8 | uint16(pix[2*x+1])
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = v, v, v, 0xffff
+			}
+		}
+	case *image.YCbCr:
+		return func(y int, row []uint16) {
+			for x := 0; x < w; x++ {
+				yi := img.YOffset(b.Min.X+x, b.Min.Y+y)
+				ci := img.COffset(b.Min.X+x, b.Min.Y+y)
+				r, g, bl := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+				row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = uint16(r)*0x101, uint16(g)*0x101, uint16(bl)*0x101, 0xffff
+			}
+		}
+	case *image.Paletted:
+		// Convert the palette once rather than per pixel
+		palette := make([][4]uint16, len(img.Palette))
+		for i, c := range img.Palette {
+			n := color.NRGBA64Model.Convert(c).(color.NRGBA64)
+			palette[i] = [4]uint16{n.R, n.G, n.B, n.A}
+		}
+		return func(y int, row []uint16) {
+			pix := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				if int(pix[x]) < len(palette) {
+					copy(row[4*x:4*x+4], palette[pix[x]][:])
+				} else {
+					clear(row[4*x : 4*x+4])
+				}
+			}
+		}
+	}
+	return func(y int, row []uint16) {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA64Model.Convert(src.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA64)
+			row[4*x], row[4*x+1], row[4*x+2], row[4*x+3] = c.R, c.G, c.B, c.A
+		}
+	}
+}
+
+// unpremultiply16 stores a premultiplied 16-bit colour as straight RGBA.
+func unpremultiply16(dst []uint16, r, g, b, a uint32) {
+	if a == 0 {
+		clear(dst[:4])
+		return
+	}
+	dst[0] = uint16(r * 0xffff / a)
+	dst[1] = uint16(g * 0xffff / a)
+	dst[2] = uint16(b * 0xffff / a)
+	dst[3] = uint16(a)
+}
+
+// newRowWriter allocates the output image and returns a function that
+// stores a premultiplied row in it, converting linear light back to sRGB
+// when transfer is set. Grey sources stay grey and 16-bit sources stay
+// 16-bit; everything else becomes NRGBA.
+func newRowWriter(src image.Image, width, height int, transfer *linearTransfer) (image.Image, func(y int, row []float32)) {
+	rect := image.Rect(0, 0, width, height)
+	switch src.(type) {
+	case *image.Gray:
+		dst := image.NewGray(rect)
+		return dst, func(y int, row []float32) {
+			pix := dst.Pix[y*dst.Stride:]
+			for x := 0; x < width; x++ {
+				pix[x] = uint8(gray(row[4*x:4*x+4], transfer)*0xff + 0.5)
+			}
+		}
+	case *image.Gray16:
+		dst := image.NewGray16(rect)
+		return dst, func(y int, row []float32) {
+			pix := dst.Pix[y*dst.Stride:]
+			for x := 0; x < width; x++ {
+				v := uint16(gray(row[4*x:4*x+4], transfer)*0xffff + 0.5)
+				pix[2*x], pix[2*x+1] = uint8(v>>8), uint8(v)
+			}
+		}
+	case *image.NRGBA64, *image.RGBA64:
+		dst := image.NewNRGBA64(rect)
+		return dst, func(y int, row []float32) {
+			pix := dst.Pix[y*dst.Stride:]
+			for i := 0; i < 4*width; i += 4 {
+				var c [4]float32
+				straighten(row[i:i+4], c[:], transfer)
+				for n, v := range c {
+					u := uint16(v*0xffff + 0.5)
+					pix[2*(i+n)], pix[2*(i+n)+1] = uint8(u>>8), uint8(u)
+				}
+			}
+		}
+	}
+	dst := image.NewNRGBA(rect)
+	return dst, func(y int, row []float32) {
+		pix := dst.Pix[y*dst.Stride:]
+		for i := 0; i < 4*width; i += 4 {
+			var c [4]float32
+			straighten(row[i:i+4], c[:], transfer)
+			for n, v := range c {
+				pix[i+n] = uint8(v*0xff + 0.5)
+			}
+		}
+	}
+}
+
+// straighten converts a premultiplied pixel back to straight sRGB colour,
+// all channels clamped to [0, 1]. Kernels with negative lobes can overshoot.
+func straighten(p, dst []float32, transfer *linearTransfer) {
+	a := unitClamp(p[3])
+	if a == 0 {
+		clear(dst[:4])
+		return
+	}
+	for c := 0; c < 3; c++ {
+		dst[c] = unitClamp(p[c] / a)
+		if transfer != nil {
+			dst[c] = transfer.encode(dst[c])
+		}
+	}
+	dst[3] = a
+}
+
+// gray returns the sRGB level of a pixel from an opaque grey source.
+func gray(p []float32, transfer *linearTransfer) float32 {
+	v := unitClamp(p[0])
+	if transfer != nil {
+		v = transfer.encode(v)
+	}
+	return v
+}
+
+func unitClamp(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// testImage returns a w x h image of the given type filled with noise.
+func testImage(kind string, w, h int) image.Image {
+	r := rand.New(rand.NewSource(int64(w*h + len(kind))))
+	rect := image.Rect(0, 0, w, h)
+	switch kind {
+	case "ycbcr":
+		img := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+		r.Read(img.Y)
+		r.Read(img.Cb)
+		r.Read(img.Cr)
+		return img
+	case "gray":
+		img := image.NewGray(rect)
+		r.Read(img.Pix)
+		return img
+	case "nrgba64":
+		img := image.NewNRGBA64(rect)
+		r.Read(img.Pix)
+		return img
+	}
+	img := image.NewNRGBA(rect)
+	r.Read(img.Pix)
+	return img
+}
+
+func resampledPixels(img image.Image) []byte {
+	switch img := img.(type) {
+	case *image.NRGBA:
+		return img.Pix
+	case *image.NRGBA64:
+		return img.Pix
+	case *image.Gray:
+		return img.Pix
+	}
+	panic(fmt.Sprintf("unexpected image type %T", img))
+}
+
+func TestResampleParallelMatchesSerial(t *testing.T) {
+	// Split even these small sizes into bands
+	defer func(work int) { resampleParallelWork = work }(resampleParallelWork)
+	resampleParallelWork = 0
+
+	sizes := []struct{ srcW, srcH, dstW, dstH int }{
+		{450, 350, 151, 111}, // downscale
+		{100, 75, 350, 261},  // upscale
+		{400, 300, 400, 61},  // one axis only
+	}
+	for _, name := range ResamplerNames() {
+		r := resamplerByName(name)
+		k, ok := r.(*kernelResampler)
+		for _, kind := range []string{"nrgba", "ycbcr", "gray", "nrgba64"} {
+			for _, size := range sizes {
+				src := testImage(kind, size.srcW, size.srcH)
+				xw, yw := nearestWeights(size.srcW, size.dstW), nearestWeights(size.srcH, size.dstH)
+				if ok {
+					xw, yw = k.weights(size.srcW, size.dstW), k.weights(size.srcH, size.dstH)
+				}
+				for _, linear := range []bool{false, true} {
+					opts := ResampleOptions{LinearLight: linear}
+					serial := resampleWorkers(src, size.dstW, size.dstH, xw, yw, opts, 1)
+					parallel := resampleWorkers(src, size.dstW, size.dstH, xw, yw, opts, 8)
+					if !bytes.Equal(resampledPixels(serial), resampledPixels(parallel)) {
+						t.Errorf("%s %s %v linear=%v: parallel output differs from serial", name, kind, size, linear)
+					}
+				}
+			}
+		}
+	}
+}
+
+// The sizes below are what the app sees: phone photos scaled to a web size
+// and a thumbnail, and large flatbed scans.
+var resampleBenchmarks = []struct {
+	name                   string
+	kind                   string
+	srcW, srcH, dstW, dstH int
+}{
+	{"12MP-photo-to-1920", "ycbcr", 4032, 3024, 1920, 1440},
+	{"12MP-photo-to-320", "ycbcr", 4032, 3024, 320, 240},
+	{"100MP-scan-to-2400", "nrgba", 11600, 8700, 2400, 1800},
+}
+
+func BenchmarkResample(b *testing.B) {
+	lanczos := resamplerByName("lanczos3").(*kernelResampler)
+	for _, bm := range resampleBenchmarks {
+		src := testImage(bm.kind, bm.srcW, bm.srcH)
+		xw, yw := lanczos.weights(bm.srcW, bm.dstW), lanczos.weights(bm.srcH, bm.dstH)
+		for _, mode := range []struct {
+			name    string
+			workers int
+		}{{"serial", 1}, {"parallel", 0}} {
+			b.Run(bm.name+"/"+mode.name, func(b *testing.B) {
+				workers := mode.workers
+				if workers == 0 {
+					workers = runtime.GOMAXPROCS(0)
+				}
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					resampleWorkers(src, bm.dstW, bm.dstH, xw, yw, ResampleOptions{}, workers)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"resizer/models"
+)
+
+// defaultRetryPolicy is used for anything a project's retry policy doesn't
+// set.
+var defaultRetryPolicy = models.RetryPolicy{
+	MaxAttempts:   3,
+	RetryDelay:    30,
+	MaxRetryDelay: 3600,
+}
+
+// maxTaskAttempts caps a project's MaxAttempts.
+const maxTaskAttempts = 100
+
+// withRetryDefaults fills the unset fields of p from defaultRetryPolicy.
+func withRetryDefaults(p models.RetryPolicy) models.RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultRetryPolicy.MaxAttempts
+	}
+	if p.RetryDelay == 0 {
+		p.RetryDelay = defaultRetryPolicy.RetryDelay
+	}
+	if p.MaxRetryDelay == 0 {
+		p.MaxRetryDelay = max(defaultRetryPolicy.MaxRetryDelay, p.RetryDelay)
+	}
+	return p
+}
+
+func validateRetryPolicy(p models.RetryPolicy) error {
+	if p.MaxAttempts < 1 || p.MaxAttempts > maxTaskAttempts {
+		return fmt.Errorf("max attempts must be between 1 and %d", maxTaskAttempts)
+	}
+	if p.RetryDelay < 1 {
+		return fmt.Errorf("retry delay must be at least 1 second")
+	}
+	if p.MaxRetryDelay < p.RetryDelay {
+		return fmt.Errorf("max retry delay must not be less than the retry delay")
+	}
+	return nil
+}
+
+// loadRetryPolicy reads the retry policy of a project.
+func loadRetryPolicy(db *sql.DB, projectID int64) (models.RetryPolicy, error) {
+	var p models.RetryPolicy
+	err := db.QueryRow("SELECT max_attempts, retry_delay, max_retry_delay FROM projects WHERE id = ?", projectID).Scan(
+		&p.MaxAttempts,
+		&p.RetryDelay,
+		&p.MaxRetryDelay,
+	)
+	if err != nil {
+		return p, fmt.Errorf("failed to get project retry policy: %w", err)
+	}
+	return withRetryDefaults(p), nil
+}
+
+// retryBackoff is how long to wait before running a task again after its
+// attempt-th run failed: the retry delay, doubled for every earlier failed
+// run, up to the max retry delay.
+func retryBackoff(p models.RetryPolicy, attempt int) time.Duration {
+	delay := time.Duration(p.RetryDelay) * time.Second
+	limit := time.Duration(p.MaxRetryDelay) * time.Second
+	for n := 1; n < attempt && delay < limit; n++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+// isTransient reports whether a task failure may go away by itself, such
+// as a file locked by another program, a full disk or a busy database.
+// Bad images, settings beyond the resource limits and crashes fail the same
+// way every time, so they aren't.
+func isTransient(err error) bool {
+	// Errors from a worker process say for themselves
+	var reported interface{ Transient() bool }
+	if errors.As(err, &reported) {
+		return reported.Transient()
+	}
+
+	var crash *crashError
+	if errors.As(err, &crash) || errors.Is(err, errLimitExceeded) {
+		return false
+	}
+	// A source that's gone won't come back
+	if errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	var errno syscall.Errno
+	return errors.As(err, &pathErr) || errors.As(err, &linkErr) || errors.As(err, &errno)
+}
+
+// RetryTask queues a failed task to run again straight away, with a fresh
+// set of attempts.
+func (i *ImageService) RetryTask(taskID int64) error {
+	_, err := i.transitionTask(taskID, taskChange{
+		action:  "retry",
+		from:    []models.TaskStatus{models.TaskFailed},
+		to:      models.TaskPending,
+		set:     "attempt_count = 0, next_attempt_at = 0, last_error = '', error_stack = ''",
+		actor:   actorUser,
+		message: "retried",
+	})
+	return err
+}
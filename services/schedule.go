@@ -0,0 +1,373 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Timezones must load on machines without a zoneinfo database, such as
+	// Windows
+	_ "time/tzdata"
+
+	"github.com/robfig/cron/v3"
+
+	"resizer/models"
+)
+
+// ScheduleService manages recurring schedules and creates their tasks.
+type ScheduleService struct {
+	db           *sql.DB
+	imageService *ImageService
+}
+
+func NewScheduleService(db *sql.DB, imageService *ImageService) *ScheduleService {
+	return &ScheduleService{db: db, imageService: imageService}
+}
+
+// parseSchedule reads a standard five field cron expression, or a
+// descriptor such as @daily or @every 1h, in timezone. An empty timezone is
+// the app's local time.
+func parseSchedule(expr, timezone string) (cron.Schedule, *time.Location, error) {
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, nil, fmt.Errorf("unknown timezone %q", timezone)
+		}
+	}
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	return schedule, loc, nil
+}
+
+// nextRun returns the first time after t that a schedule fires.
+func nextRun(expr, timezone string, t time.Time) (time.Time, error) {
+	schedule, loc, err := parseSchedule(expr, timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(t.In(loc)), nil
+}
+
+func (s *ScheduleService) CreateSchedule(projectID int64, name, cronExpr, timezone string, targetWidth, targetHeight int, opts models.TaskOptions) (*models.Schedule, error) {
+	cronExpr = strings.TrimSpace(cronExpr)
+	if name == "" {
+		name = cronExpr
+	}
+	now := time.Now()
+	next, err := nextRun(cronExpr, timezone, now)
+	if err != nil {
+		return nil, err
+	}
+	// Check the settings now rather than on every run. Encoder settings the
+	// schedule leaves unset come from the project's defaults as each task is
+	// made
+	if err := normalizeTaskOptions(&opts, targetWidth, targetHeight); err != nil {
+		return nil, err
+	}
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode task options: %w", err)
+	}
+
+	schedule := &models.Schedule{
+		ProjectID:    projectID,
+		Name:         name,
+		CronExpr:     cronExpr,
+		Timezone:     timezone,
+		TargetWidth:  targetWidth,
+		TargetHeight: targetHeight,
+		Options:      opts,
+		CreatedAt:    now,
+		NextRunAt:    next,
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO schedules (project_id, name, cron_expr, timezone, target_width, target_height, options, created_at, next_run_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, schedule.ProjectID, schedule.Name, schedule.CronExpr, schedule.Timezone, schedule.TargetWidth, schedule.TargetHeight,
+		string(options), schedule.CreatedAt, schedule.NextRunAt.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schedule: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedule ID: %w", err)
+	}
+
+	schedule.ID = id
+	s.imageService.queueChanged.notify()
+	return schedule, nil
+}
+
+// scheduleColumns is the schedules column list read by scanSchedule.
+const scheduleColumns = `id, project_id, name, cron_expr, timezone, target_width, target_height, options, paused,
+		created_at, last_run_at, next_run_at`
+
+// scanSchedule reads a row selected with scheduleColumns.
+func scanSchedule(row rowScanner, schedule *models.Schedule) error {
+	var options string
+	var lastRunAt, nextRunAt int64
+	err := row.Scan(
+		&schedule.ID,
+		&schedule.ProjectID,
+		&schedule.Name,
+		&schedule.CronExpr,
+		&schedule.Timezone,
+		&schedule.TargetWidth,
+		&schedule.TargetHeight,
+		&options,
+		&schedule.Paused,
+		&schedule.CreatedAt,
+		&lastRunAt,
+		&nextRunAt,
+	)
+	if err != nil {
+		return err
+	}
+	if lastRunAt > 0 {
+		schedule.LastRunAt = time.Unix(lastRunAt, 0)
+	}
+	if nextRunAt > 0 {
+		schedule.NextRunAt = time.Unix(nextRunAt, 0)
+	}
+	if err := json.Unmarshal([]byte(options), &schedule.Options); err != nil {
+		return fmt.Errorf("failed to decode task options: %w", err)
+	}
+	return nil
+}
+
+func (s *ScheduleService) ListSchedules(projectID int64) ([]models.Schedule, error) {
+	rows, err := s.db.Query(`
+		SELECT `+scheduleColumns+`
+		FROM schedules
+		WHERE project_id = ?
+		ORDER BY created_at DESC
+	`, projectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []models.Schedule
+	for rows.Next() {
+		var schedule models.Schedule
+		if err := scanSchedule(rows, &schedule); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, rows.Err()
+}
+
+// PauseSchedule stops a schedule making tasks until ResumeSchedule. Tasks it
+// already made are left alone.
+func (s *ScheduleService) PauseSchedule(id int64) error {
+	result, err := s.db.Exec("UPDATE schedules SET paused = 1 WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to pause schedule: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("schedule not found")
+	}
+	return nil
+}
+
+// ResumeSchedule restarts a paused schedule from its next run after now;
+// runs missed while paused are skipped.
+func (s *ScheduleService) ResumeSchedule(id int64) error {
+	var cronExpr, timezone string
+	err := s.db.QueryRow("SELECT cron_expr, timezone FROM schedules WHERE id = ?", id).Scan(&cronExpr, &timezone)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("schedule not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get schedule: %w", err)
+	}
+	next, err := nextRun(cronExpr, timezone, time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec("UPDATE schedules SET paused = 0, next_run_at = ? WHERE id = ?", next.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("failed to resume schedule: %w", err)
+	}
+	s.imageService.queueChanged.notify()
+	return nil
+}
+
+// DeleteSchedule removes a schedule. Tasks it already made are left alone.
+func (s *ScheduleService) DeleteSchedule(id int64) error {
+	result, err := s.db.Exec("DELETE FROM schedules WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("schedule not found")
+	}
+	return nil
+}
+
+// RunDueSchedules runs every schedule whose time has come and returns the
+// number of tasks made. A schedule that missed several runs while the app
+// was closed runs once.
+func (s *ScheduleService) RunDueSchedules() (int, error) {
+	now := time.Now()
+	rows, err := s.db.Query(`
+		SELECT `+scheduleColumns+`
+		FROM schedules
+		WHERE paused = 0 AND next_run_at <= ?
+		ORDER BY next_run_at ASC
+	`, now.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get due schedules: %w", err)
+	}
+	var due []models.Schedule
+	for rows.Next() {
+		var schedule models.Schedule
+		if err := scanSchedule(rows, &schedule); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		due = append(due, schedule)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to get due schedules: %w", err)
+	}
+
+	created := 0
+	for n := range due {
+		count, err := s.runSchedule(&due[n], now)
+		if err != nil {
+			log.Printf("Error running schedule %d: %v", due[n].ID, err)
+		}
+		created += count
+	}
+	return created, nil
+}
+
+// nextRunTime returns the first time after now that a schedule runs, or the
+// zero time if none will.
+func (s *ScheduleService) nextRunTime(now time.Time) (time.Time, error) {
+	var nextRunAt sql.NullInt64
+	err := s.db.QueryRow("SELECT MIN(next_run_at) FROM schedules WHERE paused = 0 AND next_run_at > ?", now.Unix()).
+		Scan(&nextRunAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get next schedule run: %w", err)
+	}
+	if !nextRunAt.Valid {
+		return time.Time{}, nil
+	}
+	return time.Unix(nextRunAt.Int64, 0), nil
+}
+
+// runSchedule makes a task for each source image in the schedule's project
+// that the schedule has no task for yet, and returns how many it made.
+func (s *ScheduleService) runSchedule(schedule *models.Schedule, now time.Time) (int, error) {
+	next, err := nextRun(schedule.CronExpr, schedule.Timezone, now)
+	if err != nil {
+		return 0, err
+	}
+
+	// Move the schedule on first, so only one app instance runs it
+	result, err := s.db.Exec(`
+		UPDATE schedules SET last_run_at = ?, next_run_at = ?
+		WHERE id = ? AND paused = 0 AND next_run_at = ?
+	`, now.Unix(), next.Unix(), schedule.ID, schedule.NextRunAt.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to update schedule: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, nil
+	}
+
+	sources, err := s.newSources(schedule)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Running schedule %d (%s): %d new images, next run at %v", schedule.ID, schedule.Name, len(sources),
+		next.Format("2006-01-02 15:04:05 MST"))
+
+	actor := fmt.Sprintf("schedule %d", schedule.ID)
+	created := 0
+	for _, source := range sources {
+		_, err := s.imageService.createTask(schedule.ProjectID, source, schedule.TargetWidth, schedule.TargetHeight,
+			now, schedule.Options, schedule.ID, actor)
+		if err != nil {
+			log.Printf("Error creating task for %s from schedule %d: %v", source, schedule.ID, err)
+			continue
+		}
+		created++
+	}
+	return created, nil
+}
+
+// newSources lists the images uploaded to a schedule's project that the
+// schedule hasn't made a task for.
+func (s *ScheduleService) newSources(schedule *models.Schedule) ([]string, error) {
+	var location string
+	err := s.db.QueryRow("SELECT location FROM projects WHERE id = ?", schedule.ProjectID).Scan(&location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project location: %w", err)
+	}
+
+	rows, err := s.db.Query("SELECT image_path FROM image_tasks WHERE schedule_id = ?", schedule.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schedule tasks: %w", err)
+	}
+	done := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan schedule task: %w", err)
+		}
+		done[path] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get schedule tasks: %w", err)
+	}
+
+	uploadsDir := filepath.Join(location, "uploads")
+	entries, err := os.ReadDir(uploadsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read uploads directory: %w", err)
+	}
+
+	var sources []string
+	for _, entry := range entries {
+		path := filepath.Join(uploadsDir, entry.Name())
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !isImageFileName(entry.Name()) || done[path] {
+			continue
+		}
+		sources = append(sources, path)
+	}
+	return sources, nil
+}
+
+// isImageFileName reports whether name has the extension of a supported
+// format.
+func isImageFileName(name string) bool {
+	ext := filepath.Ext(name)
+	for _, f := range imageFormats {
+		if f.matchesExtension(ext) {
+			return true
+		}
+	}
+	return false
+}
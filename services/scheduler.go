@@ -1,23 +1,54 @@
 package services
 
 import (
+	"context"
+	"errors"
 	"log"
 	"sync"
 	"time"
+
+	"resizer/models"
 )
 
+// signal wakes a goroutine without ever blocking the sender. Signals sent
+// while it is busy collapse into one.
+type signal chan struct{}
+
+func newSignal() signal {
+	return make(signal, 1)
+}
+
+func (s signal) notify() {
+	select {
+	case s <- struct{}{}:
+	default:
+	}
+}
+
 type Scheduler struct {
-	imageService *ImageService
-	stopChan     chan struct{}
-	wg           sync.WaitGroup
-	isRunning    bool
-	mutex        sync.Mutex
+	imageService    *ImageService
+	scheduleService *ScheduleService
+	workers         int
+	stopChan        chan struct{}
+	stopWork        context.CancelFunc // interrupts the tasks being processed
+	wg              sync.WaitGroup
+	isRunning       bool
+	mutex           sync.Mutex
+
+	queue *taskQueue
+	work  chan models.ImageTask // hands tasks from the dispatcher to the workers
 }
 
-func NewScheduler(imageService *ImageService) *Scheduler {
+// NewScheduler returns a scheduler that processes up to workers tasks at
+// once, including those it makes from recurring schedules.
+func NewScheduler(imageService *ImageService, scheduleService *ScheduleService, workers int) *Scheduler {
 	return &Scheduler{
-		imageService: imageService,
-		stopChan:     make(chan struct{}),
+		imageService:    imageService,
+		scheduleService: scheduleService,
+		workers:         max(workers, 1),
+		stopChan:        make(chan struct{}),
+		queue:           newTaskQueue(),
+		work:            make(chan models.ImageTask),
 	}
 }
 
@@ -30,11 +61,20 @@ func (s *Scheduler) Start() {
 	s.isRunning = true
 	s.mutex.Unlock()
 
-	log.Println("Scheduler started")
-	s.wg.Add(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWork = cancel
+
+	log.Printf("Scheduler started with %d workers", s.workers)
+	s.wg.Add(1 + s.workers)
 	go s.run()
+	for n := 0; n < s.workers; n++ {
+		go s.worker(ctx)
+	}
 }
 
+// Stop stops dispatching, interrupts the tasks being processed and waits
+// for the workers to requeue them. Queued tasks stay pending in the
+// database.
 func (s *Scheduler) Stop() {
 	s.mutex.Lock()
 	if !s.isRunning {
@@ -43,52 +83,272 @@ func (s *Scheduler) Stop() {
 	}
 	s.isRunning = false
 	close(s.stopChan)
+	s.stopWork()
 	s.mutex.Unlock()
 
 	s.wg.Wait()
 }
 
+// idleCheck is the longest the dispatcher sleeps. Every change made through
+// this app instance wakes it straight away, so for a lone instance the
+// check finds nothing and logs nothing. It is still needed because tasks
+// and schedules created, requeued or resumed by other app instances sharing
+// the database send no signal here; without it they would wait until
+// something local happened to wake the dispatcher.
+const idleCheck = time.Minute
+
+// run is the dispatcher. It sleeps until the next task falls due, a lease
+// runs out or a schedule fires, or until the queue changes, then refills the
+// queue and hands the next task to whichever worker is free, without ever
+// waiting on a task itself.
 func (s *Scheduler) run() {
 	defer s.wg.Done()
 
-	log.Println("Scheduler running, checking tasks every 5 seconds")
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	log.Println("Scheduler running")
+	// The first check straight away also catches tasks left processing when
+	// the app last quit or crashed
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	for {
+		// Sending on a nil channel blocks, which leaves only the other
+		// cases while the queue is empty
+		var work chan models.ImageTask
+		next, ok := s.queue.peek()
+		if ok {
+			work = s.work
+		}
+
 		select {
 		case <-s.stopChan:
 			log.Println("Scheduler stopping")
 			return
-		case <-ticker.C:
-			currentTime := time.Now()
-			log.Printf("Scheduler checking for pending tasks at %v MYT", currentTime.Format("2006-01-02 15:04:05 MST"))
-			s.processPendingTasks()
+		case <-timer.C:
+			s.check()
+			resetTimer(timer, s.untilNextWakeup())
+		case <-s.imageService.queueChanged:
+			s.check()
+			resetTimer(timer, s.untilNextWakeup())
+		case work <- next:
+			s.queue.pop()
 		}
 	}
 }
 
-func (s *Scheduler) processPendingTasks() {
-	currentTime := time.Now()
-	log.Printf("Checking for pending tasks at %v MYT", currentTime.Format("2006-01-02 15:04:05 MST"))
+// check recovers orphaned tasks, runs due schedules and queues the pending
+// tasks that are due.
+func (s *Scheduler) check() {
+	s.recoverOrphanedTasks()
+	s.runDueSchedules()
+	s.queuePendingTasks()
+}
 
+// untilNextWakeup returns how long the dispatcher can sleep before a
+// pending task falls due, a lease runs out or a schedule fires.
+func (s *Scheduler) untilNextWakeup() time.Duration {
+	now := time.Now()
+	wakeup := now.Add(idleCheck)
+	taskTime, err := s.imageService.nextTaskTime(now)
+	if err != nil {
+		log.Printf("Error finding the next task time: %v", err)
+	} else if !taskTime.IsZero() && taskTime.Before(wakeup) {
+		wakeup = taskTime
+	}
+	runTime, err := s.scheduleService.nextRunTime(now)
+	if err != nil {
+		log.Printf("Error finding the next schedule run: %v", err)
+	} else if !runTime.IsZero() && runTime.Before(wakeup) {
+		wakeup = runTime
+	}
+	return wakeup.Sub(now)
+}
+
+// resetTimer makes timer fire after d, whether or not it already fired.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
+
+// worker processes tasks from the dispatcher until the scheduler stops.
+// Stopping cancels ctx, which interrupts the task in hand.
+func (s *Scheduler) worker(ctx context.Context) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.stopChan:
+			return
+		case task := <-s.work:
+			s.processTask(ctx, task)
+		}
+	}
+}
+
+// recoverOrphanedTasks requeues or fails tasks whose app instance is gone,
+// found by their lapsed lease or, on this machine, their exited process.
+func (s *Scheduler) recoverOrphanedTasks() {
+	n, err := s.imageService.RecoverOrphanedTasks()
+	if err != nil {
+		log.Printf("Error recovering orphaned tasks: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Recovered %d orphaned tasks", n)
+	}
+}
+
+// runDueSchedules makes the tasks of recurring schedules whose time has
+// come.
+func (s *Scheduler) runDueSchedules() {
+	n, err := s.scheduleService.RunDueSchedules()
+	if err != nil {
+		log.Printf("Error running schedules: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Schedules created %d tasks", n)
+	}
+}
+
+func (s *Scheduler) queuePendingTasks() {
+	currentTime := time.Now()
 	tasks, err := s.imageService.GetPendingTasks()
 	if err != nil {
 		log.Printf("Error getting pending tasks: %v", err)
 		return
 	}
 
-	log.Printf("Found %d pending tasks at %v MYT", len(tasks), currentTime.Format("2006-01-02 15:04:05 MST"))
+	queued := s.queue.refill(tasks)
+	if len(tasks) > 0 {
+		log.Printf("Found %d pending tasks at %v MYT, %d queued", len(tasks), currentTime.Format("2006-01-02 15:04:05 MST"), queued)
+	}
+}
+
+func (s *Scheduler) processTask(ctx context.Context, queued models.ImageTask) {
+	defer s.queue.finish(queued.ID)
+
+	// Another worker or app instance may have won the task since it was
+	// queued
+	task, err := s.imageService.ClaimTask(queued.ID)
+	if err != nil {
+		log.Printf("Error claiming task %d: %v", queued.ID, err)
+		return
+	}
+	if task == nil {
+		log.Printf("Task %d was claimed elsewhere, skipping", queued.ID)
+		return
+	}
+
+	currentTime := time.Now()
+	log.Printf("Processing task %d (scheduled for %v MYT, current time: %v MYT)",
+		task.ID,
+		task.ScheduledFor.Format("2006-01-02 15:04:05 MST"),
+		currentTime.Format("2006-01-02 15:04:05 MST"),
+	)
+	err = s.imageService.ProcessImage(ctx, task)
+	if errors.Is(err, errTaskCancelled) {
+		log.Printf("Task %d was cancelled while processing", task.ID)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		log.Printf("Task %d was interrupted by shutdown and requeued", task.ID)
+		return
+	}
+	if err != nil {
+		log.Printf("Error processing image task %d: %v", task.ID, err)
+		return
+	}
+	log.Printf("Successfully processed task %d", task.ID)
+}
+
+// taskQueue holds the pending tasks waiting for a worker, one queue per
+// project. Projects take turns so a big batch in one project doesn't hold
+// up the others.
+type taskQueue struct {
+	mu        sync.Mutex
+	projects  []int64 // round-robin order; the front project goes next
+	byProject map[int64][]models.ImageTask
+	running   map[int64]bool // task IDs handed to a worker and not yet finished
+}
+
+func newTaskQueue() *taskQueue {
+	return &taskQueue{
+		byProject: make(map[int64][]models.ImageTask),
+		running:   make(map[int64]bool),
+	}
+}
+
+// refill replaces the queued tasks with tasks, the current pending tasks in
+// the order they should run within each project, leaving out any already
+// running. Projects keep their turn; new ones join at the back. It returns
+// the number of tasks queued.
+func (q *taskQueue) refill(tasks []models.ImageTask) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	byProject := make(map[int64][]models.ImageTask)
+	var newProjects []int64
+	queued := 0
 	for _, task := range tasks {
-		log.Printf("Processing task %d (scheduled for %v MYT, current time: %v MYT)",
-			task.ID,
-			task.ScheduledFor.Format("2006-01-02 15:04:05 MST"),
-			currentTime.Format("2006-01-02 15:04:05 MST"),
-		)
-		if err := s.imageService.ProcessImage(&task); err != nil {
-			log.Printf("Error processing image task %d: %v", task.ID, err)
+		if q.running[task.ID] {
 			continue
 		}
-		log.Printf("Successfully processed task %d", task.ID)
+		if _, ok := byProject[task.ProjectID]; !ok {
+			if _, known := q.byProject[task.ProjectID]; !known {
+				newProjects = append(newProjects, task.ProjectID)
+			}
+		}
+		byProject[task.ProjectID] = append(byProject[task.ProjectID], task)
+		queued++
+	}
+
+	var projects []int64
+	for _, id := range append(q.projects, newProjects...) {
+		if len(byProject[id]) > 0 {
+			projects = append(projects, id)
+		}
+	}
+	q.projects, q.byProject = projects, byProject
+	return queued
+}
+
+// peek returns the task that goes next.
+func (q *taskQueue) peek() (models.ImageTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.projects) == 0 {
+		return models.ImageTask{}, false
 	}
+	return q.byProject[q.projects[0]][0], true
+}
+
+// pop marks the task returned by peek as running and moves its project to
+// the back of the line.
+func (q *taskQueue) pop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	project := q.projects[0]
+	tasks := q.byProject[project]
+	q.running[tasks[0].ID] = true
+	q.projects = q.projects[1:]
+	if len(tasks) > 1 {
+		q.byProject[project] = tasks[1:]
+		q.projects = append(q.projects, project)
+	} else {
+		delete(q.byProject, project)
+	}
+}
+
+// finish forgets a task once its worker is done with it.
+func (q *taskQueue) finish(taskID int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, taskID)
 }
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"resizer/models"
+)
+
+// SettingsService reads and writes app-wide settings, stored as key/value
+// rows in the settings table.
+type SettingsService struct {
+	db *sql.DB
+}
+
+func NewSettingsService(db *sql.DB) *SettingsService {
+	return &SettingsService{db: db}
+}
+
+// limitSettings maps the settings table keys to the fields of l.
+func limitSettings(l *models.Limits) map[string]*int64 {
+	return map[string]*int64{
+		"max_pixels":      &l.MaxPixels,
+		"max_file_size":   &l.MaxFileSize,
+		"max_task_memory": &l.MaxTaskMemory,
+	}
+}
+
+// loadLimits reads the current limits, falling back to the defaults for
+// any that were never set.
+func loadLimits(db *sql.DB) (models.Limits, error) {
+	limits := defaultLimits
+	fields := limitSettings(&limits)
+
+	rows, err := db.Query("SELECT key, value FROM settings")
+	if err != nil {
+		return limits, fmt.Errorf("failed to get settings: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return limits, fmt.Errorf("failed to scan setting: %w", err)
+		}
+		field, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if *field, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return limits, fmt.Errorf("invalid %s setting %q", key, value)
+		}
+	}
+	return limits, rows.Err()
+}
+
+func (s *SettingsService) GetLimits() (*models.Limits, error) {
+	limits, err := loadLimits(s.db)
+	if err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+func (s *SettingsService) UpdateLimits(limits *models.Limits) error {
+	fields := limitSettings(limits)
+	for key, field := range fields {
+		if *field < 0 {
+			return fmt.Errorf("%s cannot be negative", key)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for key, field := range fields {
+		if err := saveSetting(tx, key, strconv.FormatInt(*field, 10)); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SettingsService) GetWorkerProcess() (bool, error) {
+	return loadWorkerProcess(s.db)
+}
+
+// UpdateWorkerProcess chooses whether tasks are decoded and resized in a
+// separate worker process, so a malformed file can never crash the app.
+func (s *SettingsService) UpdateWorkerProcess(enabled bool) error {
+	return saveSetting(s.db, "worker_process", strconv.FormatBool(enabled))
+}
+
+// loadWorkerProcess reports whether tasks run in a worker process. They run
+// in the app by default.
+func loadWorkerProcess(db *sql.DB) (bool, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'worker_process'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get worker process setting: %w", err)
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid worker_process setting %q", value)
+	}
+	return enabled, nil
+}
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// saveSetting stores one setting, replacing any earlier value.
+func saveSetting(db execer, key, value string) error {
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value
+	`, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to save %s setting: %w", key, err)
+	}
+	return nil
+}
+
+// Worker pool sizes
+const (
+	defaultWorkerCount = 2
+	maxWorkerCount     = 16
+)
+
+func (s *SettingsService) GetWorkerCount() (int, error) {
+	return loadWorkerCount(s.db)
+}
+
+// UpdateWorkerCount sets how many tasks the scheduler processes at once.
+// It takes effect the next time the scheduler starts.
+func (s *SettingsService) UpdateWorkerCount(workers int) error {
+	if workers < 1 || workers > maxWorkerCount {
+		return fmt.Errorf("worker count must be between 1 and %d", maxWorkerCount)
+	}
+	return saveSetting(s.db, "worker_count", strconv.Itoa(workers))
+}
+
+// loadWorkerCount returns the scheduler's worker pool size.
+func loadWorkerCount(db *sql.DB) (int, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'worker_count'").Scan(&value)
+	if err == sql.ErrNoRows {
+		return defaultWorkerCount, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get worker count setting: %w", err)
+	}
+	workers, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid worker_count setting %q", value)
+	}
+	return workers, nil
+}
+
+func (s *SettingsService) GetOrphanPolicy() (string, error) {
+	return loadOrphanPolicy(s.db)
+}
+
+// UpdateOrphanPolicy chooses what happens to tasks an app instance left
+// processing when it quit or crashed: requeue or fail.
+func (s *SettingsService) UpdateOrphanPolicy(policy string) error {
+	if policy != models.OrphanRequeue && policy != models.OrphanFail {
+		return fmt.Errorf("invalid orphan policy %q", policy)
+	}
+	return saveSetting(s.db, "orphan_policy", policy)
+}
+
+// loadOrphanPolicy returns the orphan policy, requeue unless set.
+func loadOrphanPolicy(db *sql.DB) (string, error) {
+	var policy string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = 'orphan_policy'").Scan(&policy)
+	if err == sql.ErrNoRows {
+		return models.OrphanRequeue, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get orphan policy setting: %w", err)
+	}
+	return policy, nil
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+
+	"resizer/models"
+	"resizer/services/jpegscale"
+)
+
+// decodedImage is a decoded source: a still image, or every frame of a GIF.
+type decodedImage struct {
+	img      image.Image
+	anim     *gif.GIF
+	lossless bool           // the source is lossless WebP
+	meta     *imageMetadata // copied into JPEG and PNG outputs
+	full     image.Point    // upright size before a reduced JPEG decode, else zero
+}
+
+// decodeImage decodes data, whose format has already been detected. Still
+// images are turned upright according to their EXIF orientation, so the
+// pixels no longer depend on the tag. GIF has no EXIF.
+//
+// A shrink of 2, 4 or 8 decodes a JPEG at that fraction of its size; plans
+// are still made against the full size, see render.
+func decodeImage(data []byte, format *imageFormat, shrink int) (*decodedImage, error) {
+	r := bytes.NewReader(data)
+	src := &decodedImage{}
+	var err error
+	switch format.Name {
+	case "jpeg":
+		if shrink > 1 {
+			src.img, err = jpegscale.Decode(r, shrink)
+			break
+		}
+		src.img, err = jpeg.Decode(r)
+	case "png":
+		src.img, err = png.Decode(r)
+	case "gif":
+		// Decode semua frame supaya animation tak hilang
+		src.anim, err = gif.DecodeAll(r)
+	case "webp":
+		// Keep lossless sources lossless when writing them back out
+		if src.lossless, err = isLosslessWebP(r); err == nil {
+			_, err = r.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			src.img, err = decodeWebP(r)
+		}
+	default:
+		err = fmt.Errorf("unsupported image format")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if src.img != nil {
+		orientation := exifOrientation(findEXIF(data, format))
+		if shrink > 1 {
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			src.full.X, src.full.Y = orientedSize(cfg.Width, cfg.Height, orientation)
+		}
+		src.img = applyOrientation(src.img, orientation)
+	}
+	src.meta = readMetadata(data, format)
+	return src, nil
+}
+
+// prepareColor applies the task's colour profile handling and returns the
+// name of the source profile. Profiles that can't be converted are kept so
+// colours stay right, and non-RGB profiles are dropped because the outputs
+// are always RGB (or grey) pixels.
+func (d *decodedImage) prepareColor(mode string) string {
+	if d.meta.icc == nil {
+		return ""
+	}
+	profile, err := parseICC(d.meta.icc)
+	if err != nil {
+		log.Printf("Dropping unreadable ICC profile: %v", err)
+		d.meta.icc = nil
+		return ""
+	}
+
+	switch {
+	case profile.colorSpace != "RGB":
+		log.Printf("Dropping %s ICC profile %q", profile.colorSpace, profile.name())
+		d.meta.icc = nil
+	case mode == models.ColorProfileKeep:
+	case !profile.hasMatrix:
+		log.Printf("Cannot convert ICC profile %q to sRGB; keeping it", profile.name())
+	default:
+		// Untagged output is read as sRGB
+		if !profile.isSRGB() && d.img != nil {
+			log.Printf("Converting from %q to sRGB", profile.name())
+			d.img = convertToSRGB(d.img, profile)
+		}
+		d.meta.icc = nil
+	}
+	return profile.name()
+}
+
+// size returns the source's pixel dimensions, at full size even after a
+// reduced decode.
+func (d *decodedImage) size() (int, int) {
+	if d.anim != nil {
+		return gifSize(d.anim)
+	}
+	if d.full != (image.Point{}) {
+		return d.full.X, d.full.Y
+	}
+	b := d.img.Bounds()
+	return b.Dx(), b.Dy()
+}
+
+// shrinkFactor picks the largest JPEG decode scale (8, 4 or 2) that still
+// leaves every output's crop at least as big as its scaled size, so the
+// resampler only ever finishes a downscale. It returns 1 when no reduced
+// decode applies. w and h are the upright source size.
+func shrinkFactor(format *imageFormat, w, h int, task *models.ImageTask) int {
+	if format.Name != "jpeg" {
+		return 1
+	}
+	var plans []resizePlan
+	for _, target := range taskTargets(task) {
+		plan, err := planTarget(task, target, w, h)
+		if err != nil {
+			return 1
+		}
+		plans = append(plans, plan)
+	}
+	for _, s := range []int{8, 4, 2} {
+		fits := true
+		for _, plan := range plans {
+			if plan.crop.Dx()/s < plan.scaled.X || plan.crop.Dy()/s < plan.scaled.Y {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return s
+		}
+	}
+	return 1
+}
+
+// reduceRect maps r from a full-size image onto the same image decoded at
+// size reduced, keeping at least one pixel.
+func reduceRect(r image.Rectangle, full, reduced image.Point) image.Rectangle {
+	scale := func(v, from, to int) int {
+		return min(to, int(float64(v)*float64(to)/float64(from)+0.5))
+	}
+	out := image.Rect(
+		scale(r.Min.X, full.X, reduced.X), scale(r.Min.Y, full.Y, reduced.Y),
+		scale(r.Max.X, full.X, reduced.X), scale(r.Max.Y, full.Y, reduced.Y),
+	)
+	if out.Dx() == 0 {
+		out.Min.X = max(0, out.Max.X-1)
+		out.Max.X = out.Min.X + 1
+	}
+	if out.Dy() == 0 {
+		out.Min.Y = max(0, out.Max.Y-1)
+		out.Max.Y = out.Min.Y + 1
+	}
+	return out
+}
+
+// render resizes the source according to plan. Animations are kept only for
+// GIF output; other formats get the first frame. Transparency is flattened
+// onto the plan's background for formats that cannot store it. Once ctx is
+// cancelled the resize stops and the result is incomplete.
+func (d *decodedImage) render(ctx context.Context, plan resizePlan, format *imageFormat) (image.Image, *gif.GIF) {
+	plan.resample.Context = ctx
+	if d.anim != nil && format.Name == "gif" {
+		return nil, resizeGIF(d.anim, plan)
+	}
+
+	img := d.img
+	if d.anim != nil {
+		img = gifFirstFrame(d.anim)
+	}
+	if d.full != (image.Point{}) {
+		plan.crop = reduceRect(plan.crop, d.full, img.Bounds().Size())
+	}
+	resized := applyResize(img, plan)
+	if opaque, ok := resized.(interface{ Opaque() bool }); !format.Alpha && !(ok && opaque.Opaque()) {
+		resized = flattenImage(resized, plan.background)
+	}
+	return resized, nil
+}
+
+// encode renders the source according to plan and encodes it, including the
+// source's metadata so size limits see the real file size.
+func (d *decodedImage) encode(ctx context.Context, plan resizePlan, format *imageFormat, settings models.EncoderSettings) ([]byte, error) {
+	img, anim := d.render(ctx, plan, format)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.encodeRendered(img, anim, plan, format, settings)
+}
+
+// encodeRendered encodes what render returned for plan, so one render can
+// be encoded with different settings.
+func (d *decodedImage) encodeRendered(img image.Image, anim *gif.GIF, plan resizePlan, format *imageFormat, settings models.EncoderSettings) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, anim, format, settings, d.lossless); err != nil {
+		return nil, err
+	}
+	return d.meta.embed(buf.Bytes(), format, plan.canvas.X, plan.canvas.Y), nil
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"resizer/models"
+)
+
+// actorUser is the actor of changes asked for through the app, as opposed
+// to those made by an app instance's scheduler.
+const actorUser = "user"
+
+// taskTransitions lists the statuses each status may move to. A status
+// moving to itself is a change that keeps it, such as a reschedule.
+var taskTransitions = map[models.TaskStatus][]models.TaskStatus{
+	"":                    {models.TaskPending},
+	models.TaskPending:    {models.TaskPending, models.TaskProcessing, models.TaskPaused, models.TaskCancelled},
+	models.TaskPaused:     {models.TaskPaused, models.TaskPending, models.TaskCancelled},
+	models.TaskProcessing: {models.TaskCompleted, models.TaskFailed, models.TaskPending, models.TaskCancelled},
+	models.TaskFailed:     {models.TaskPending},
+	models.TaskCancelled:  {models.TaskPending},
+	models.TaskCompleted:  {},
+}
+
+// canTransition reports whether a task may move from one status to another.
+func canTransition(from, to models.TaskStatus) bool {
+	for _, next := range taskTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// errTaskNotFound is returned for changes to a task that doesn't exist.
+var errTaskNotFound = errors.New("task not found")
+
+// transitionError means a task wasn't in a state a change applies to.
+type transitionError struct {
+	action string
+	status models.TaskStatus
+}
+
+func (e *transitionError) Error() string {
+	return fmt.Sprintf("cannot %s a task that is %s", e.action, e.status)
+}
+
+// taskChange is a status change made by transitionTask.
+type taskChange struct {
+	action string              // what the change does, for errors, e.g. "pause"
+	from   []models.TaskStatus // statuses the change applies to
+	to     models.TaskStatus
+	stay   []models.TaskStatus // statuses kept as they are instead of moving to to
+
+	set       string        // other columns to update, as SQL assignments
+	setArgs   []interface{} // arguments of set
+	where     string        // a further condition the task must meet, as SQL
+	whereArgs []interface{} // arguments of where
+
+	actor   string
+	message string
+	retryAt time.Time // when a retry may run, recorded on the event
+
+	// within, if set, runs in the same transaction after the update
+	within func(tx *sql.Tx) error
+}
+
+// transitionTask applies change to a task and records it in task_events,
+// in one transaction. It returns the task's status before the change, or
+// a *transitionError if the task isn't in one of the change's from statuses
+// or doesn't meet its where condition. Moves taskTransitions doesn't allow
+// are rejected.
+func (i *ImageService) transitionTask(taskID int64, change taskChange) (models.TaskStatus, error) {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current models.TaskStatus
+	err = tx.QueryRow("SELECT status FROM image_tasks WHERE id = ?", taskID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return "", errTaskNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get task status: %w", err)
+	}
+	if !hasStatus(change.from, current) {
+		return current, &transitionError{action: change.action, status: current}
+	}
+	to := change.to
+	if hasStatus(change.stay, current) {
+		to = current
+	}
+	if !canTransition(current, to) {
+		return current, fmt.Errorf("illegal task transition from %s to %s", current, to)
+	}
+
+	query := "UPDATE image_tasks SET status = ?"
+	args := []interface{}{to}
+	if change.set != "" {
+		query += ", " + change.set
+		args = append(args, change.setArgs...)
+	}
+	query += " WHERE id = ? AND status = ?"
+	args = append(args, taskID, current)
+	if change.where != "" {
+		query += " AND " + change.where
+		args = append(args, change.whereArgs...)
+	}
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return current, fmt.Errorf("failed to %s task: %w", change.action, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return current, &transitionError{action: change.action, status: current}
+	}
+
+	if err := recordEvent(tx, taskID, current, to, change.actor, change.message, change.retryAt); err != nil {
+		return current, err
+	}
+	if change.within != nil {
+		if err := change.within(tx); err != nil {
+			return current, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return current, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	if to == models.TaskPending {
+		i.queueChanged.notify()
+	}
+	return current, nil
+}
+
+func hasStatus(statuses []models.TaskStatus, status models.TaskStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// recordEvent adds a status change to a task's history. retryAt is zero
+// unless the change schedules a retry.
+func recordEvent(db execer, taskID int64, from, to models.TaskStatus, actor, message string, retryAt time.Time) error {
+	var retryUnix int64
+	if !retryAt.IsZero() {
+		retryUnix = retryAt.Unix()
+	}
+	_, err := db.Exec(`
+		INSERT INTO task_events (task_id, from_status, to_status, actor, message, created_at, retry_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, taskID, from, to, actor, message, time.Now(), retryUnix)
+	if err != nil {
+		return fmt.Errorf("failed to record task event: %w", err)
+	}
+	return nil
+}
+
+// loadTaskEvents fills in the events and timings of tasks, all from one
+// project.
+func (i *ImageService) loadTaskEvents(projectID int64, tasks []models.ImageTask) error {
+	rows, err := i.db.Query(`
+		SELECT id, task_id, from_status, to_status, actor, message, created_at, retry_at
+		FROM task_events
+		WHERE task_id IN (SELECT id FROM image_tasks WHERE project_id = ?)
+		ORDER BY id ASC
+	`, projectID)
+	if err != nil {
+		return fmt.Errorf("failed to get task events: %w", err)
+	}
+	defer rows.Close()
+
+	byTask := make(map[int64][]models.TaskEvent)
+	for rows.Next() {
+		var event models.TaskEvent
+		var retryAt int64
+		err := rows.Scan(
+			&event.ID,
+			&event.TaskID,
+			&event.From,
+			&event.To,
+			&event.Actor,
+			&event.Message,
+			&event.CreatedAt,
+			&retryAt,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to scan task event: %w", err)
+		}
+		if retryAt > 0 {
+			event.RetryAt = time.Unix(retryAt, 0)
+		}
+		byTask[event.TaskID] = append(byTask[event.TaskID], event)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to get task events: %w", err)
+	}
+
+	now := time.Now()
+	for n := range tasks {
+		task := &tasks[n]
+		task.Events = byTask[task.ID]
+		wait, processing := taskTimings(task, now)
+		task.WaitSeconds, task.ProcessingSeconds = wait.Seconds(), processing.Seconds()
+	}
+	return nil
+}
+
+// taskTimings sums from a task's events how long it waited to be picked up
+// once it was due, and how long it spent processing. A retry is due once
+// its backoff is over; the backoff itself isn't waiting.
+func taskTimings(task *models.ImageTask, now time.Time) (wait, processing time.Duration) {
+	for n, event := range task.Events {
+		end := now
+		if n+1 < len(task.Events) {
+			end = task.Events[n+1].CreatedAt
+		}
+		switch event.To {
+		case models.TaskPending:
+			start := event.CreatedAt
+			if task.ScheduledFor.After(start) {
+				start = task.ScheduledFor
+			}
+			if event.RetryAt.After(start) {
+				start = event.RetryAt
+			}
+			if end.After(start) {
+				wait += end.Sub(start)
+			}
+		case models.TaskProcessing:
+			processing += end.Sub(event.CreatedAt)
+		}
+	}
+	return wait, processing
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+
+	"golang.org/x/image/webp"
+)
+
+// webpMaxDimension is the largest width or height a WebP image can have.
+const webpMaxDimension = 16383
+
+// webpDefaultQuality is the lossy quality used when none is given.
+const webpDefaultQuality = 75
+
+// webpOptions controls how encodeWebP compresses an image.
+type webpOptions struct {
+	Lossless bool
+	Quality  int // 1-100, lossy only
+}
+
+// encodeWebP writes img as a WebP file. Lossless output is a single VP8L
+// chunk. Lossy output is a VP8 chunk, wrapped in a VP8X container with an
+// ALPH chunk when the image has transparency.
+func encodeWebP(w io.Writer, img image.Image, opts *webpOptions) error {
+	if opts == nil {
+		opts = &webpOptions{Quality: webpDefaultQuality}
+	}
+
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("failed to encode webp: empty image")
+	}
+	if width > webpMaxDimension || height > webpMaxDimension {
+		return fmt.Errorf("failed to encode webp: %dx%d exceeds the %dx%d limit", width, height, webpMaxDimension, webpMaxDimension)
+	}
+
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Rect, img, b.Min, draw.Src)
+	}
+
+	var chunks [][]byte
+	if opts.Lossless {
+		chunks = append(chunks, webpChunk("VP8L", encodeVP8L(nrgba.Pix, nrgba.Stride, width, height)))
+	} else {
+		quality := opts.Quality
+		if quality <= 0 {
+			quality = webpDefaultQuality
+		}
+		if !nrgba.Opaque() {
+			vp8x := make([]byte, 10)
+			vp8x[0] = 0x10 // Alpha flag.
+			putUint24(vp8x[4:], uint32(width-1))
+			putUint24(vp8x[7:], uint32(height-1))
+			alph := append([]byte{1}, encodeVP8LAlpha(nrgba.Pix, nrgba.Stride, width, height)...)
+			chunks = append(chunks, webpChunk("VP8X", vp8x), webpChunk("ALPH", alph))
+		}
+		chunks = append(chunks, webpChunk("VP8 ", encodeVP8(nrgba.Pix, nrgba.Stride, width, height, quality)))
+	}
+
+	size := 4
+	for _, c := range chunks {
+		size += len(c)
+	}
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(size))
+	copy(header[8:], "WEBP")
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write webp header: %w", err)
+	}
+	for _, c := range chunks {
+		if _, err := w.Write(c); err != nil {
+			return fmt.Errorf("failed to write webp chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// decodeWebP decodes a WebP image. Lossy frames come back from the decoder as
+// Y'CbCr, which the standard library would convert to RGB with full-range
+// JPEG coefficients; VP8 uses limited-range BT.601, so convert them here the
+// way libwebp does to keep colours (and decode/encode round trips) faithful.
+func decodeWebP(r io.Reader) (image.Image, error) {
+	img, err := webp.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var ycc *image.YCbCr
+	var alpha []uint8
+	var alphaStride int
+	switch m := img.(type) {
+	case *image.YCbCr:
+		ycc = m
+	case *image.NYCbCrA:
+		ycc, alpha, alphaStride = &m.YCbCr, m.A, m.AStride
+	default:
+		return img, nil
+	}
+
+	b := ycc.Rect
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := out.Pix[(y-b.Min.Y)*out.Stride:]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			yy := int(ycc.Y[ycc.YOffset(x, y)])
+			ci := ycc.COffset(x, y)
+			u, v := int(ycc.Cb[ci]), int(ycc.Cr[ci])
+			luma := yy * 19077 >> 8
+			p := row[4*(x-b.Min.X):]
+			p[0] = vp8YUVClip(luma + v*26149>>8 - 14234)
+			p[1] = vp8YUVClip(luma - u*6419>>8 - v*13320>>8 + 8708)
+			p[2] = vp8YUVClip(luma + u*33050>>8 - 17685)
+			p[3] = 0xff
+			if alpha != nil {
+				p[3] = alpha[(y-b.Min.Y)*alphaStride+x-b.Min.X]
+			}
+		}
+	}
+	return out, nil
+}
+
+// vp8YUVClip scales a 14-bit fixed point colour value back to 8 bits.
+func vp8YUVClip(v int) uint8 {
+	if v&^16383 == 0 {
+		return uint8(v >> 6)
+	}
+	if v < 0 {
+		return 0
+	}
+	return 0xff
+}
+
+// webpChunk frames data as a RIFF chunk, padded to an even length.
+func webpChunk(fourCC string, data []byte) []byte {
+	c := make([]byte, 8, 8+len(data)+1)
+	copy(c, fourCC)
+	binary.LittleEndian.PutUint32(c[4:], uint32(len(data)))
+	c = append(c, data...)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// isLosslessWebP reports whether the WebP file read from r stores its image
+// in a VP8L chunk. It walks the RIFF chunks and stops at the first image
+// chunk, so the pixel data is not read.
+func isLosslessWebP(r io.Reader) (bool, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false, fmt.Errorf("failed to read webp header: %w", err)
+	}
+	if string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return false, fmt.Errorf("not a webp file")
+	}
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return false, fmt.Errorf("failed to read webp chunk: %w", err)
+		}
+		switch string(chunk[:4]) {
+		case "VP8L":
+			return true, nil
+		case "VP8 ", "ANMF":
+			return false, nil
+		}
+		n := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if _, err := io.CopyN(io.Discard, r, n+n&1); err != nil {
+			return false, fmt.Errorf("failed to skip webp chunk: %w", err)
+		}
+	}
+}
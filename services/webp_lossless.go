@@ -0,0 +1,823 @@
+package services
+
+import (
+	"sort"
+)
+
+// This file implements a VP8L (WebP lossless) encoder. The bitstream is
+// described in "WebP Lossless Bitstream Specification" (RFC 9649). It uses
+// the subtract-green and predictor transforms for photographic content,
+// a colour-indexing transform for images with a small palette, and LZ77
+// backward references with a single group of prefix (Huffman) codes.
+
+const (
+	vp8lMagic = 0x2f
+
+	vp8lTransformPredictor     = 0
+	vp8lTransformSubtractGreen = 2
+	vp8lTransformColorIndexing = 3
+
+	vp8lPredictorTileBits = 4
+
+	vp8lNumLiteralCodes  = 256
+	vp8lNumLengthCodes   = 24
+	vp8lNumDistanceCodes = 40
+
+	vp8lMaxCodeLength           = 15
+	vp8lMaxCodeLengthCodeLength = 7
+
+	vp8lMinMatchLength = 3
+	vp8lMaxMatchLength = 4096
+	vp8lHashBits       = 16
+	vp8lMaxChainLength = 48
+	vp8lMaxDistance    = 1<<20 - 120
+)
+
+// vp8lCodeLengthCodeOrder is the order in which the code length code lengths
+// are stored in the bitstream.
+var vp8lCodeLengthCodeOrder = [19]uint8{
+	17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// vp8lDistanceMapTable maps the 120 short distance codes to (x, y) offsets.
+// Each entry holds yOffset in the high nibble and 8-xOffset in the low one.
+var vp8lDistanceMapTable = [120]uint8{
+	0x18, 0x07, 0x17, 0x19, 0x28, 0x06, 0x27, 0x29, 0x16, 0x1a,
+	0x26, 0x2a, 0x38, 0x05, 0x37, 0x39, 0x15, 0x1b, 0x36, 0x3a,
+	0x25, 0x2b, 0x48, 0x04, 0x47, 0x49, 0x14, 0x1c, 0x35, 0x3b,
+	0x46, 0x4a, 0x24, 0x2c, 0x58, 0x45, 0x4b, 0x34, 0x3c, 0x03,
+	0x57, 0x59, 0x13, 0x1d, 0x56, 0x5a, 0x23, 0x2d, 0x44, 0x4c,
+	0x55, 0x5b, 0x33, 0x3d, 0x68, 0x02, 0x67, 0x69, 0x12, 0x1e,
+	0x66, 0x6a, 0x22, 0x2e, 0x54, 0x5c, 0x43, 0x4d, 0x65, 0x6b,
+	0x32, 0x3e, 0x78, 0x01, 0x77, 0x79, 0x53, 0x5d, 0x11, 0x1f,
+	0x64, 0x6c, 0x42, 0x4e, 0x76, 0x7a, 0x21, 0x2f, 0x75, 0x7b,
+	0x31, 0x3f, 0x63, 0x6d, 0x52, 0x5e, 0x00, 0x74, 0x7c, 0x41,
+	0x4f, 0x10, 0x20, 0x62, 0x6e, 0x30, 0x73, 0x7d, 0x51, 0x5f,
+	0x40, 0x72, 0x7e, 0x61, 0x6f, 0x50, 0x71, 0x7f, 0x60, 0x70,
+}
+
+// vp8lBitWriter writes bits least-significant first, as VP8L requires.
+type vp8lBitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+func (w *vp8lBitWriter) writeBits(v uint32, n uint) {
+	w.bits |= uint64(v) << w.nBits
+	w.nBits += n
+	for w.nBits >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.nBits -= 8
+	}
+}
+
+func (w *vp8lBitWriter) bytes() []byte {
+	if w.nBits > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.nBits = 0, 0
+	}
+	return w.buf
+}
+
+// vp8lPrefixCode is a canonical prefix code. lengths are the code lengths
+// stored in the bitstream; bits and codes are what is actually written for
+// each symbol (a code with a single symbol is written with zero bits).
+type vp8lPrefixCode struct {
+	lengths []uint8
+	bits    []uint8
+	codes   []uint16
+}
+
+func (c *vp8lPrefixCode) write(w *vp8lBitWriter, symbol int) {
+	w.writeBits(uint32(c.codes[symbol]), uint(c.bits[symbol]))
+}
+
+// newVP8LPrefixCode builds a length-limited canonical prefix code for the
+// given symbol histogram.
+func newVP8LPrefixCode(histogram []uint32, maxLength int) *vp8lPrefixCode {
+	c := &vp8lPrefixCode{
+		lengths: huffmanCodeLengths(histogram, maxLength),
+		bits:    make([]uint8, len(histogram)),
+		codes:   make([]uint16, len(histogram)),
+	}
+
+	used := 0
+	for _, l := range c.lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	if used <= 1 {
+		return c
+	}
+
+	var count [vp8lMaxCodeLength + 1]uint32
+	for _, l := range c.lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [vp8lMaxCodeLength + 1]uint32
+	code := uint32(0)
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range c.lengths {
+		if l == 0 {
+			continue
+		}
+		code := next[l]
+		next[l]++
+		// Codes are read most-significant bit first, so store them reversed.
+		rev := uint16(0)
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | uint16(code>>i&1)
+		}
+		c.codes[s] = rev
+		c.bits[s] = l
+	}
+	return c
+}
+
+// huffmanCodeLengths computes Huffman code lengths no longer than maxLength.
+// Over-long codes are avoided by flattening the histogram and retrying.
+func huffmanCodeLengths(histogram []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(histogram))
+
+	type node struct {
+		weight uint64
+		symbol int
+		left   int
+		right  int
+	}
+
+	for minWeight := uint64(1); ; minWeight *= 2 {
+		nodes := make([]node, 0, 2*len(histogram))
+		for s, h := range histogram {
+			if h == 0 {
+				continue
+			}
+			weight := uint64(h)
+			if weight < minWeight {
+				weight = minWeight
+			}
+			nodes = append(nodes, node{weight: weight, symbol: s, left: -1, right: -1})
+		}
+		switch len(nodes) {
+		case 0:
+			return lengths
+		case 1:
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].weight < nodes[j].weight
+		})
+
+		// Two-queue Huffman construction: leaves are already sorted and
+		// internal nodes are created in non-decreasing weight order.
+		nLeaves := len(nodes)
+		leaf, internal := 0, nLeaves
+		pick := func() int {
+			if leaf < nLeaves && (internal >= len(nodes) || nodes[leaf].weight <= nodes[internal].weight) {
+				leaf++
+				return leaf - 1
+			}
+			internal++
+			return internal - 1
+		}
+		for i := 0; i < nLeaves-1; i++ {
+			a := pick()
+			b := pick()
+			nodes = append(nodes, node{
+				weight: nodes[a].weight + nodes[b].weight,
+				symbol: -1,
+				left:   a,
+				right:  b,
+			})
+		}
+
+		depth := make([]int, len(nodes))
+		tooLong := false
+		for i := len(nodes) - 1; i >= 0; i-- {
+			n := nodes[i]
+			if n.left < 0 {
+				if depth[i] > maxLength {
+					tooLong = true
+				}
+				continue
+			}
+			depth[n.left] = depth[i] + 1
+			depth[n.right] = depth[i] + 1
+		}
+		if tooLong {
+			continue
+		}
+		for i := 0; i < nLeaves; i++ {
+			lengths[nodes[i].symbol] = uint8(depth[i])
+		}
+		return lengths
+	}
+}
+
+// writePrefixCode stores a prefix code's lengths in the bitstream, using the
+// simple one- or two-symbol form where possible.
+func (w *vp8lBitWriter) writePrefixCode(c *vp8lPrefixCode) {
+	var symbols []int
+	for s, l := range c.lengths {
+		if l > 0 {
+			symbols = append(symbols, s)
+			if len(symbols) > 2 {
+				break
+			}
+		}
+	}
+
+	if len(symbols) == 0 {
+		// An unused code: a simple code with the single symbol 0.
+		w.writeBits(1, 1)
+		w.writeBits(0, 1)
+		w.writeBits(0, 1)
+		w.writeBits(0, 1)
+		return
+	}
+	if len(symbols) <= 2 && symbols[len(symbols)-1] < 256 {
+		w.writeBits(1, 1)
+		w.writeBits(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			w.writeBits(0, 1)
+			w.writeBits(uint32(symbols[0]), 1)
+		} else {
+			w.writeBits(1, 1)
+			w.writeBits(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			w.writeBits(uint32(symbols[1]), 8)
+		}
+		return
+	}
+
+	// Run-length encode the code lengths with symbols 16 (repeat previous),
+	// 17 (short zero run) and 18 (long zero run).
+	type token struct {
+		symbol     uint8
+		extra      uint32
+		extraWidth uint
+	}
+	var tokens []token
+	prev := uint8(8)
+	for i := 0; i < len(c.lengths); {
+		v := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == v {
+			run++
+		}
+		i += run
+		if v == 0 {
+			for run >= 11 {
+				r := run
+				if r > 138 {
+					r = 138
+				}
+				tokens = append(tokens, token{18, uint32(r - 11), 7})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, token{17, uint32(run - 3), 3})
+				run = 0
+			}
+			for ; run > 0; run-- {
+				tokens = append(tokens, token{0, 0, 0})
+			}
+			continue
+		}
+		if v != prev {
+			tokens = append(tokens, token{v, 0, 0})
+			prev = v
+			run--
+		}
+		for run >= 3 {
+			r := run
+			if r > 6 {
+				r = 6
+			}
+			tokens = append(tokens, token{16, uint32(r - 3), 2})
+			run -= r
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{v, 0, 0})
+		}
+	}
+
+	histogram := make([]uint32, 19)
+	for _, t := range tokens {
+		histogram[t.symbol]++
+	}
+	lengthCode := newVP8LPrefixCode(histogram, vp8lMaxCodeLengthCodeLength)
+
+	nCodes := 19
+	for nCodes > 4 && lengthCode.lengths[vp8lCodeLengthCodeOrder[nCodes-1]] == 0 {
+		nCodes--
+	}
+	w.writeBits(0, 1)
+	w.writeBits(uint32(nCodes-4), 4)
+	for i := 0; i < nCodes; i++ {
+		w.writeBits(uint32(lengthCode.lengths[vp8lCodeLengthCodeOrder[i]]), 3)
+	}
+	// Every symbol's length is stored, so max_symbol is not used.
+	w.writeBits(0, 1)
+	for _, t := range tokens {
+		lengthCode.write(w, int(t.symbol))
+		if t.extraWidth > 0 {
+			w.writeBits(t.extra, t.extraWidth)
+		}
+	}
+}
+
+// vp8lPrefixEncode splits an LZ77 length or distance code value into a prefix
+// symbol and its extra bits.
+func vp8lPrefixEncode(v int) (symbol int, extra uint32, extraWidth uint) {
+	n := v - 1
+	if n < 4 {
+		return n, 0, 0
+	}
+	h := 0
+	for n>>(h+1) != 0 {
+		h++
+	}
+	second := (n >> (h - 1)) & 1
+	extraWidth = uint(h - 1)
+	return 2*h + second, uint32(n) & (1<<extraWidth - 1), extraWidth
+}
+
+// vp8lToken is either a literal ARGB pixel or a backward reference.
+type vp8lToken struct {
+	argb     uint32
+	length   int
+	distCode int
+}
+
+// vp8lBackwardReferences finds LZ77 matches with a hash chain. Distances are
+// converted to VP8L distance codes for an image of the given width.
+func vp8lBackwardReferences(argb []uint32, width int) []vp8lToken {
+	n := len(argb)
+	tokens := make([]vp8lToken, 0, n/2)
+
+	shortCodes := make(map[int]int, len(vp8lDistanceMapTable))
+	for i := len(vp8lDistanceMapTable) - 1; i >= 0; i-- {
+		c := vp8lDistanceMapTable[i]
+		d := int(c>>4)*width + 8 - int(c&0x0f)
+		if d >= 1 {
+			shortCodes[d] = i + 1
+		}
+	}
+	distCode := func(d int) int {
+		if c, ok := shortCodes[d]; ok {
+			return c
+		}
+		return d + len(vp8lDistanceMapTable)
+	}
+
+	head := make([]int32, 1<<vp8lHashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, n)
+	hash := func(i int) uint32 {
+		h := argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1
+		return h >> (32 - vp8lHashBits)
+	}
+	insert := func(i int) {
+		if i+1 >= n {
+			return
+		}
+		h := hash(i)
+		chain[i] = head[h]
+		head[h] = int32(i)
+	}
+	matchLength := func(i, j, limit int) int {
+		l := 0
+		for l < limit && argb[i+l] == argb[j+l] {
+			l++
+		}
+		return l
+	}
+
+	for i := 0; i < n; {
+		limit := n - i
+		if limit > vp8lMaxMatchLength {
+			limit = vp8lMaxMatchLength
+		}
+		bestLen, bestDist := 0, 0
+		// The pixel to the left and the pixel above are cheap, common matches.
+		for _, d := range [2]int{1, width} {
+			if d <= i {
+				if l := matchLength(i, i-d, limit); l > bestLen {
+					bestLen, bestDist = l, d
+				}
+			}
+		}
+		if i+1 < n && bestLen < limit {
+			steps := 0
+			for j := head[hash(i)]; j >= 0 && steps < vp8lMaxChainLength; j = chain[j] {
+				d := i - int(j)
+				if d > vp8lMaxDistance {
+					break
+				}
+				if l := matchLength(i, int(j), limit); l > bestLen {
+					bestLen, bestDist = l, d
+					if l == limit {
+						break
+					}
+				}
+				steps++
+			}
+		}
+
+		if bestLen >= vp8lMinMatchLength {
+			tokens = append(tokens, vp8lToken{length: bestLen, distCode: distCode(bestDist)})
+			for k := 0; k < bestLen; k++ {
+				insert(i + k)
+			}
+			i += bestLen
+			continue
+		}
+		tokens = append(tokens, vp8lToken{argb: argb[i]})
+		insert(i)
+		i++
+	}
+	return tokens
+}
+
+// writeImageData entropy-codes an ARGB image as a single prefix code group.
+// The main image (topLevel) also signals that no meta prefix codes are used.
+func (w *vp8lBitWriter) writeImageData(argb []uint32, width int, topLevel bool) {
+	tokens := vp8lBackwardReferences(argb, width)
+
+	var (
+		green    = make([]uint32, vp8lNumLiteralCodes+vp8lNumLengthCodes)
+		red      = make([]uint32, vp8lNumLiteralCodes)
+		blue     = make([]uint32, vp8lNumLiteralCodes)
+		alpha    = make([]uint32, vp8lNumLiteralCodes)
+		distance = make([]uint32, vp8lNumDistanceCodes)
+	)
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[t.argb>>8&0xff]++
+			red[t.argb>>16&0xff]++
+			blue[t.argb&0xff]++
+			alpha[t.argb>>24]++
+			continue
+		}
+		s, _, _ := vp8lPrefixEncode(t.length)
+		green[vp8lNumLiteralCodes+s]++
+		s, _, _ = vp8lPrefixEncode(t.distCode)
+		distance[s]++
+	}
+	codes := [5]*vp8lPrefixCode{
+		newVP8LPrefixCode(green, vp8lMaxCodeLength),
+		newVP8LPrefixCode(red, vp8lMaxCodeLength),
+		newVP8LPrefixCode(blue, vp8lMaxCodeLength),
+		newVP8LPrefixCode(alpha, vp8lMaxCodeLength),
+		newVP8LPrefixCode(distance, vp8lMaxCodeLength),
+	}
+
+	// No colour cache.
+	w.writeBits(0, 1)
+	if topLevel {
+		// No meta prefix codes.
+		w.writeBits(0, 1)
+	}
+	for _, c := range codes {
+		w.writePrefixCode(c)
+	}
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			codes[0].write(w, int(t.argb>>8&0xff))
+			codes[1].write(w, int(t.argb>>16&0xff))
+			codes[2].write(w, int(t.argb&0xff))
+			codes[3].write(w, int(t.argb>>24))
+			continue
+		}
+		s, extra, width := vp8lPrefixEncode(t.length)
+		codes[0].write(w, vp8lNumLiteralCodes+s)
+		w.writeBits(extra, width)
+		s, extra, width = vp8lPrefixEncode(t.distCode)
+		codes[4].write(w, s)
+		w.writeBits(extra, width)
+	}
+}
+
+// writeImageStream applies transforms to argb and writes the transformed
+// image. It is shared by the VP8L chunk and the lossless alpha (ALPH) chunk,
+// which omits the VP8L header.
+func (w *vp8lBitWriter) writeImageStream(argb []uint32, width, height int) {
+	if palette, ok := vp8lPalette(argb, 256); ok {
+		packed, packedWidth := vp8lApplyPalette(argb, width, height, palette)
+
+		w.writeBits(1, 1)
+		w.writeBits(vp8lTransformColorIndexing, 2)
+		w.writeBits(uint32(len(palette)-1), 8)
+		// The palette is stored delta-coded, one entry per pixel.
+		deltas := make([]uint32, len(palette))
+		for i := range palette {
+			if i == 0 {
+				deltas[i] = palette[i]
+				continue
+			}
+			deltas[i] = vp8lSubPixels(palette[i], palette[i-1])
+		}
+		w.writeImageData(deltas, len(deltas), false)
+
+		w.writeBits(0, 1)
+		w.writeImageData(packed, packedWidth, true)
+		return
+	}
+
+	residuals := make([]uint32, len(argb))
+	for i, p := range argb {
+		g := p >> 8 & 0xff
+		r := (p>>16 - g) & 0xff
+		b := (p - g) & 0xff
+		residuals[i] = p&0xff00ff00 | r<<16 | b
+	}
+	w.writeBits(1, 1)
+	w.writeBits(vp8lTransformSubtractGreen, 2)
+
+	modes, tilesWide := vp8lPredict(residuals, width, height)
+	w.writeBits(1, 1)
+	w.writeBits(vp8lTransformPredictor, 2)
+	w.writeBits(vp8lPredictorTileBits-2, 3)
+	w.writeImageData(modes, tilesWide, false)
+
+	w.writeBits(0, 1)
+	w.writeImageData(residuals, width, true)
+}
+
+// vp8lPalette returns the sorted distinct colours of argb if there are no more
+// than max of them.
+func vp8lPalette(argb []uint32, max int) ([]uint32, bool) {
+	seen := make(map[uint32]struct{}, max+1)
+	for _, p := range argb {
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		if len(seen) > max {
+			return nil, false
+		}
+	}
+	palette := make([]uint32, 0, len(seen))
+	for p := range seen {
+		palette = append(palette, p)
+	}
+	sort.Slice(palette, func(i, j int) bool { return palette[i] < palette[j] })
+	return palette, true
+}
+
+// vp8lApplyPalette replaces pixels by palette indices stored in the green
+// channel, bundling several indices into one pixel for small palettes.
+func vp8lApplyPalette(argb []uint32, width, height int, palette []uint32) ([]uint32, int) {
+	index := make(map[uint32]uint32, len(palette))
+	for i, p := range palette {
+		index[p] = uint32(i)
+	}
+	bits := uint(0)
+	switch {
+	case len(palette) <= 2:
+		bits = 3
+	case len(palette) <= 4:
+		bits = 2
+	case len(palette) <= 16:
+		bits = 1
+	}
+	perPixel := 8 >> bits
+	packedWidth := (width + 1<<bits - 1) >> bits
+	packed := make([]uint32, packedWidth*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := index[argb[y*width+x]]
+			packed[y*packedWidth+x>>bits] |= v << (8 + uint(x&(1<<bits-1)*perPixel))
+		}
+	}
+	for i := range packed {
+		packed[i] |= 0xff000000
+	}
+	return packed, packedWidth
+}
+
+// vp8lPredict applies the predictor transform in place, choosing the best of
+// the 14 predictors for each tile, and returns the tile mode image.
+func vp8lPredict(argb []uint32, width, height int) ([]uint32, int) {
+	tileSize := 1 << vp8lPredictorTileBits
+	tilesWide := (width + tileSize - 1) / tileSize
+	tilesHigh := (height + tileSize - 1) / tileSize
+	modes := make([]uint32, tilesWide*tilesHigh)
+
+	// Modes are chosen from the original pixels, then residuals are written
+	// bottom-up so that each prediction still sees unmodified neighbours.
+	for ty := 0; ty < tilesHigh; ty++ {
+		for tx := 0; tx < tilesWide; tx++ {
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := ty * tileSize; y < height && y < (ty+1)*tileSize; y++ {
+					for x := tx * tileSize; x < width && x < (tx+1)*tileSize; x++ {
+						r := vp8lSubPixels(argb[y*width+x], vp8lPredictPixel(argb, width, x, y, mode))
+						cost += vp8lResidualCost(r)
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesWide+tx] = 0xff000000 | uint32(best)<<8
+		}
+	}
+
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			mode := int(modes[(y>>vp8lPredictorTileBits)*tilesWide+x>>vp8lPredictorTileBits] >> 8 & 0x0f)
+			i := y*width + x
+			argb[i] = vp8lSubPixels(argb[i], vp8lPredictPixel(argb, width, x, y, mode))
+		}
+	}
+	return modes, tilesWide
+}
+
+func vp8lResidualCost(p uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(int8(p >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// vp8lPredictPixel returns the prediction for pixel (x, y). The top row and
+// left column always use the fixed predictors mandated by the format.
+func vp8lPredictPixel(argb []uint32, width, x, y, mode int) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+	l := argb[i-1]
+	t := argb[i-width]
+	tl := argb[i-width-1]
+	// For the rightmost column, the top-right pixel is the first pixel of
+	// the current row, which is simply the next pixel in memory.
+	tr := argb[i-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return vp8lAverage2(vp8lAverage2(l, tr), t)
+	case 6:
+		return vp8lAverage2(l, tl)
+	case 7:
+		return vp8lAverage2(l, t)
+	case 8:
+		return vp8lAverage2(tl, t)
+	case 9:
+		return vp8lAverage2(t, tr)
+	case 10:
+		return vp8lAverage2(vp8lAverage2(l, tl), vp8lAverage2(t, tr))
+	case 11:
+		return vp8lSelect(l, t, tl)
+	case 12:
+		return vp8lClampAddSubtractFull(l, t, tl)
+	default:
+		return vp8lClampAddSubtractHalf(vp8lAverage2(l, t), tl)
+	}
+}
+
+func vp8lSubPixels(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		out |= uint32(uint8(a>>shift)-uint8(b>>shift)) << shift
+	}
+	return out
+}
+
+func vp8lAverage2(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		out |= (a>>shift&0xff + b>>shift&0xff) / 2 << shift
+	}
+	return out
+}
+
+func vp8lSelect(l, t, tl uint32) uint32 {
+	predictL, predictT := 0, 0
+	for shift := 0; shift < 32; shift += 8 {
+		c := int(tl >> shift & 0xff)
+		predictL += absInt(c - int(t>>shift&0xff))
+		predictT += absInt(c - int(l>>shift&0xff))
+	}
+	if predictL < predictT {
+		return l
+	}
+	return t
+}
+
+func vp8lClampAddSubtractFull(a, b, c uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) + int(b>>shift&0xff) - int(c>>shift&0xff)
+		out |= uint32(clampByte(v)) << shift
+	}
+	return out
+}
+
+func vp8lClampAddSubtractHalf(a, b uint32) uint32 {
+	var out uint32
+	for shift := 0; shift < 32; shift += 8 {
+		av := int(a >> shift & 0xff)
+		v := av + (av-int(b>>shift&0xff))/2
+		out |= uint32(clampByte(v)) << shift
+	}
+	return out
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func clampByte(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// encodeVP8L returns the payload of a VP8L chunk for a non-premultiplied
+// RGBA image.
+func encodeVP8L(pix []uint8, stride, width, height int) []byte {
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < width; x++ {
+			r, g, b, a := row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]
+			if a != 0xff {
+				hasAlpha = true
+			}
+			argb[y*width+x] = uint32(a)<<24 | uint32(r)<<16 | uint32(g)<<8 | uint32(b)
+		}
+	}
+
+	w := &vp8lBitWriter{}
+	w.writeBits(vp8lMagic, 8)
+	w.writeBits(uint32(width-1), 14)
+	w.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+	w.writeBits(0, 3)
+	w.writeImageStream(argb, width, height)
+	return w.bytes()
+}
+
+// encodeVP8LAlpha returns a headerless VP8L stream carrying the alpha channel
+// of a non-premultiplied RGBA image in its green channel, as used by
+// compressed ALPH chunks.
+func encodeVP8LAlpha(pix []uint8, stride, width, height int) []byte {
+	argb := make([]uint32, width*height)
+	for y := 0; y < height; y++ {
+		row := pix[y*stride:]
+		for x := 0; x < width; x++ {
+			argb[y*width+x] = 0xff000000 | uint32(row[4*x+3])<<8
+		}
+	}
+
+	w := &vp8lBitWriter{}
+	w.writeImageStream(argb, width, height)
+	return w.bytes()
+}
@@ -0,0 +1,1205 @@
+package services
+
+// This file implements a VP8 (WebP lossy) key frame encoder, following
+// RFC 6386. Every macroblock uses 16x16 luma prediction with the best of the
+// DC, TM, V and H predictors, residuals are transformed with the VP8 DCT and
+// WHT, and coefficients are coded with the default token probabilities.
+
+const (
+	vp8PredDC = iota
+	vp8PredTM
+	vp8PredVE
+	vp8PredHE
+	vp8NumPredModes
+)
+
+const (
+	vp8PlaneY1WithY2 = 0
+	vp8PlaneY2       = 1
+	vp8PlaneUV       = 2
+)
+
+// vp8BoolEncoder is the boolean entropy encoder of RFC 6386 section 7.
+type vp8BoolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newVP8BoolEncoder() *vp8BoolEncoder {
+	return &vp8BoolEncoder{rng: 255, bitCount: 24}
+}
+
+func (e *vp8BoolEncoder) writeBool(prob uint8, bit bool) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			// Propagate the carry into the bytes already written.
+			i := len(e.buf) - 1
+			for i >= 0 && e.buf[i] == 0xff {
+				e.buf[i] = 0
+				i--
+			}
+			if i >= 0 {
+				e.buf[i]++
+			}
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+func (e *vp8BoolEncoder) writeLiteral(v uint32, n int) {
+	for n > 0 {
+		n--
+		e.writeBool(128, v>>uint(n)&1 != 0)
+	}
+}
+
+func (e *vp8BoolEncoder) writeOptionalSigned(v int32, n int) {
+	if v == 0 {
+		e.writeBool(128, false)
+		return
+	}
+	e.writeBool(128, true)
+	if v < 0 {
+		e.writeLiteral(uint32(-v), n)
+		e.writeBool(128, true)
+	} else {
+		e.writeLiteral(uint32(v), n)
+		e.writeBool(128, false)
+	}
+}
+
+func (e *vp8BoolEncoder) bytes() []byte {
+	for i := 0; i < 32; i++ {
+		e.writeBool(128, false)
+	}
+	return e.buf
+}
+
+// vp8QualityToIndex maps a 0-100 quality to a quantizer index (0 is the
+// finest, 127 the coarsest).
+func vp8QualityToIndex(quality int) int {
+	if quality < 0 {
+		quality = 0
+	}
+	if quality > 100 {
+		quality = 100
+	}
+	c := float64(quality) / 100
+	if c < 0.75 {
+		c *= 2.0 / 3
+	} else {
+		c = 2*c - 1
+	}
+	q := int(127*(1-c) + 0.5)
+	if q < 0 {
+		q = 0
+	}
+	if q > 127 {
+		q = 127
+	}
+	return q
+}
+
+// vp8Quant holds the DC and AC quantizer steps for each coefficient type.
+type vp8Quant struct {
+	y1, y2, uv [2]int32
+}
+
+func newVP8Quant(q int) vp8Quant {
+	var m vp8Quant
+	m.y1 = [2]int32{int32(vp8DCTable[q]), int32(vp8ACTable[q])}
+	m.y2 = [2]int32{int32(vp8DCTable[q]) * 2, int32(vp8ACTable[q]) * 155 / 100}
+	if m.y2[1] < 8 {
+		m.y2[1] = 8
+	}
+	uvDC := q
+	if uvDC > 117 {
+		uvDC = 117
+	}
+	m.uv = [2]int32{int32(vp8DCTable[uvDC]), int32(vp8ACTable[q])}
+	return m
+}
+
+// vp8QuantizeBlock quantizes coefficients in place, leaving the dequantized values
+// in coeffs and returning the levels.
+func vp8QuantizeBlock(coeffs *[16]int32, steps [2]int32, first int) (levels [16]int32) {
+	for i := first; i < 16; i++ {
+		step := steps[1]
+		bias := step * 3 / 8
+		if i == 0 {
+			step = steps[0]
+			bias = step / 2
+		}
+		v := coeffs[i]
+		neg := v < 0
+		if neg {
+			v = -v
+		}
+		level := (v + bias) / step
+		if level > 2048 {
+			level = 2048
+		}
+		if neg {
+			level = -level
+		}
+		levels[i] = level
+		coeffs[i] = level * step
+	}
+	return levels
+}
+
+// vp8ForwardDCT is the forward transform used by libvpx (vp8_short_fdct4x4).
+func vp8ForwardDCT(in *[16]int32) (out [16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		ip := in[4*i:]
+		a1 := (ip[0] + ip[3]) * 8
+		b1 := (ip[1] + ip[2]) * 8
+		c1 := (ip[1] - ip[2]) * 8
+		d1 := (ip[0] - ip[3]) * 8
+		tmp[4*i+0] = a1 + b1
+		tmp[4*i+2] = a1 - b1
+		tmp[4*i+1] = (c1*2217 + d1*5352 + 14500) >> 12
+		tmp[4*i+3] = (d1*2217 - c1*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a1 := tmp[i] + tmp[12+i]
+		b1 := tmp[4+i] + tmp[8+i]
+		c1 := tmp[4+i] - tmp[8+i]
+		d1 := tmp[i] - tmp[12+i]
+		out[i] = (a1 + b1 + 7) >> 4
+		out[8+i] = (a1 - b1 + 7) >> 4
+		out[4+i] = (c1*2217 + d1*5352 + 12000) >> 16
+		if d1 != 0 {
+			out[4+i]++
+		}
+		out[12+i] = (d1*2217 - c1*5352 + 51000) >> 16
+	}
+	return out
+}
+
+// vp8ForwardWHT is the forward Walsh-Hadamard transform of the 16 luma DC
+// coefficients (vp8_short_walsh4x4).
+func vp8ForwardWHT(in *[16]int32) (out [16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		ip := in[4*i:]
+		a1 := (ip[0] + ip[2]) * 4
+		d1 := (ip[1] + ip[3]) * 4
+		c1 := (ip[1] - ip[3]) * 4
+		b1 := (ip[0] - ip[2]) * 4
+		tmp[4*i+0] = a1 + d1
+		if a1 != 0 {
+			tmp[4*i+0]++
+		}
+		tmp[4*i+1] = b1 + c1
+		tmp[4*i+2] = b1 - c1
+		tmp[4*i+3] = a1 - d1
+	}
+	for i := 0; i < 4; i++ {
+		a1 := tmp[i] + tmp[8+i]
+		d1 := tmp[4+i] + tmp[12+i]
+		c1 := tmp[4+i] - tmp[12+i]
+		b1 := tmp[i] - tmp[8+i]
+		v := [4]int32{a1 + d1, b1 + c1, b1 - c1, a1 - d1}
+		for j, x := range v {
+			if x < 0 {
+				x++
+			}
+			out[4*j+i] = (x + 3) >> 3
+		}
+	}
+	return out
+}
+
+// vp8InverseDCT adds the inverse transform of coeffs to the 4x4 block at
+// dst, exactly as the decoder does.
+func vp8InverseDCT(coeffs *[16]int32, dst []uint8, stride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2).
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2).
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := coeffs[i] + coeffs[8+i]
+		b := coeffs[i] - coeffs[8+i]
+		c := (coeffs[4+i]*c2)>>16 - (coeffs[12+i]*c1)>>16
+		d := (coeffs[4+i]*c1)>>16 + (coeffs[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := dst[j*stride:]
+		row[0] = clampByte(int(int32(row[0]) + (a+d)>>3))
+		row[1] = clampByte(int(int32(row[1]) + (b+c)>>3))
+		row[2] = clampByte(int(int32(row[2]) + (b-c)>>3))
+		row[3] = clampByte(int(int32(row[3]) + (a-d)>>3))
+	}
+}
+
+// vp8InverseWHT returns the 16 luma DC coefficients, in block order.
+func vp8InverseWHT(in *[16]int32) (out [16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := in[i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[i] - in[12+i]
+		m[i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[4*i] + 3
+		a0 := dc + m[4*i+3]
+		a1 := m[4*i+1] + m[4*i+2]
+		a2 := m[4*i+1] - m[4*i+2]
+		a3 := dc - m[4*i+3]
+		out[4*i+0] = (a0 + a1) >> 3
+		out[4*i+1] = (a3 + a2) >> 3
+		out[4*i+2] = (a0 - a1) >> 3
+		out[4*i+3] = (a3 - a2) >> 3
+	}
+	return out
+}
+
+// vp8Plane is a padded 8-bit sample plane.
+type vp8Plane struct {
+	pix    []uint8
+	stride int
+}
+
+// vp8Predict fills pred (size x size) with the given predictor. Edge samples
+// follow the decoder: the row above the image is 127, the column left of it
+// is 129, and DC prediction averages only the available edges.
+func vp8Predict(pred []uint8, recon *vp8Plane, x0, y0, size, mode int) {
+	var top, left [16]int32
+	var corner int32
+	hasTop, hasLeft := y0 > 0, x0 > 0
+	for i := 0; i < size; i++ {
+		top[i], left[i] = 127, 129
+		if hasTop {
+			top[i] = int32(recon.pix[(y0-1)*recon.stride+x0+i])
+		}
+		if hasLeft {
+			left[i] = int32(recon.pix[(y0+i)*recon.stride+x0-1])
+		}
+	}
+	switch {
+	case !hasTop:
+		corner = 127
+	case !hasLeft:
+		corner = 129
+	default:
+		corner = int32(recon.pix[(y0-1)*recon.stride+x0-1])
+	}
+
+	switch mode {
+	case vp8PredDC:
+		shift := 3
+		if size == 16 {
+			shift = 4
+		}
+		var sum, dc int32
+		switch {
+		case hasTop && hasLeft:
+			for i := 0; i < size; i++ {
+				sum += top[i] + left[i]
+			}
+			dc = (sum + int32(size)) >> uint(shift+1)
+		case hasTop:
+			for i := 0; i < size; i++ {
+				sum += top[i]
+			}
+			dc = (sum + int32(size)/2) >> uint(shift)
+		case hasLeft:
+			for i := 0; i < size; i++ {
+				sum += left[i]
+			}
+			dc = (sum + int32(size)/2) >> uint(shift)
+		default:
+			dc = 128
+		}
+		for i := 0; i < size*size; i++ {
+			pred[i] = uint8(dc)
+		}
+	case vp8PredTM:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = clampByte(int(left[j] + top[i] - corner))
+			}
+		}
+	case vp8PredVE:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = uint8(top[i])
+			}
+		}
+	case vp8PredHE:
+		for j := 0; j < size; j++ {
+			for i := 0; i < size; i++ {
+				pred[j*size+i] = uint8(left[j])
+			}
+		}
+	}
+}
+
+func vp8SSE(src *vp8Plane, x0, y0 int, pred []uint8, size int) int {
+	sse := 0
+	for j := 0; j < size; j++ {
+		row := src.pix[(y0+j)*src.stride+x0:]
+		for i := 0; i < size; i++ {
+			d := int(row[i]) - int(pred[j*size+i])
+			sse += d * d
+		}
+	}
+	return sse
+}
+
+// vp8Macroblock is the coded form of one macroblock.
+type vp8Macroblock struct {
+	lumaMode, chromaMode int
+	skip                 bool
+	y2                   [16]int32
+	y                    [16][16]int32
+	u, v                 [4][16]int32
+}
+
+// vp8Encoder encodes one key frame.
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+	src           [3]vp8Plane
+	recon         [3]vp8Plane
+	quant         vp8Quant
+	qIndex        int
+}
+
+// encodeVP8 returns the payload of a VP8 chunk for a non-premultiplied RGBA
+// image. Alpha is ignored; it is stored separately in an ALPH chunk.
+func encodeVP8(pix []uint8, stride, width, height, quality int) []byte {
+	e := &vp8Encoder{
+		width:  width,
+		height: height,
+		mbw:    (width + 15) / 16,
+		mbh:    (height + 15) / 16,
+		qIndex: vp8QualityToIndex(quality),
+	}
+	e.quant = newVP8Quant(e.qIndex)
+	e.convert(pix, stride)
+
+	mbs := make([]vp8Macroblock, e.mbw*e.mbh)
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(&mbs[mby*e.mbw+mbx], mbx, mby)
+		}
+	}
+
+	nParts := 1
+	if e.mbw*e.mbh > 4096 {
+		nParts = 8
+	}
+	parts := make([]*vp8BoolEncoder, nParts)
+	for i := range parts {
+		parts[i] = newVP8BoolEncoder()
+	}
+	e.writeTokens(mbs, parts)
+
+	first := e.writeHeaders(mbs, nParts)
+	out := make([]byte, 0, 10+len(first)+64)
+	tag := uint32(len(first))<<5 | 1<<4
+	out = append(out, byte(tag), byte(tag>>8), byte(tag>>16))
+	out = append(out, 0x9d, 0x01, 0x2a)
+	out = append(out, byte(width), byte(width>>8), byte(height), byte(height>>8))
+	out = append(out, first...)
+	partData := make([][]byte, nParts)
+	for i, p := range parts {
+		partData[i] = p.bytes()
+	}
+	for i := 0; i < nParts-1; i++ {
+		n := len(partData[i])
+		out = append(out, byte(n), byte(n>>8), byte(n>>16))
+	}
+	for _, p := range partData {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// convert converts RGBA to Y'CbCr 4:2:0 using the same BT.601 coefficients as
+// libwebp, padding the planes to whole macroblocks by edge replication.
+func (e *vp8Encoder) convert(pix []uint8, stride int) {
+	yw, yh := e.mbw*16, e.mbh*16
+	cw, ch := e.mbw*8, e.mbh*8
+	e.src[0] = vp8Plane{make([]uint8, yw*yh), yw}
+	e.src[1] = vp8Plane{make([]uint8, cw*ch), cw}
+	e.src[2] = vp8Plane{make([]uint8, cw*ch), cw}
+	for i := range e.recon {
+		e.recon[i] = vp8Plane{make([]uint8, len(e.src[i].pix)), e.src[i].stride}
+	}
+
+	at := func(x, y int) (int32, int32, int32) {
+		if x >= e.width {
+			x = e.width - 1
+		}
+		if y >= e.height {
+			y = e.height - 1
+		}
+		p := pix[y*stride+4*x:]
+		return int32(p[0]), int32(p[1]), int32(p[2])
+	}
+	for y := 0; y < yh; y++ {
+		for x := 0; x < yw; x++ {
+			r, g, b := at(x, y)
+			e.src[0].pix[y*yw+x] = uint8((16839*r + 33059*g + 6420*b + 1<<15 + 16<<16) >> 16)
+		}
+	}
+	for y := 0; y < ch; y++ {
+		for x := 0; x < cw; x++ {
+			var r, g, b int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := at(2*x+d[0], 2*y+d[1])
+				r, g, b = r+pr, g+pg, b+pb
+			}
+			u := (-9719*r - 19081*g + 28800*b + 1<<17 + 128<<18) >> 18
+			v := (28800*r - 24116*g - 4684*b + 1<<17 + 128<<18) >> 18
+			e.src[1].pix[y*cw+x] = clampByte(int(u))
+			e.src[2].pix[y*cw+x] = clampByte(int(v))
+		}
+	}
+}
+
+// encodeMacroblock chooses predictors, quantizes the residuals and writes the
+// reconstruction used to predict later macroblocks.
+func (e *vp8Encoder) encodeMacroblock(mb *vp8Macroblock, mbx, mby int) {
+	var pred [256]uint8
+	var cpred [2][64]uint8
+
+	x0, y0 := mbx*16, mby*16
+	best := -1
+	for mode := 0; mode < vp8NumPredModes; mode++ {
+		var p [256]uint8
+		vp8Predict(p[:], &e.recon[0], x0, y0, 16, mode)
+		if sse := vp8SSE(&e.src[0], x0, y0, p[:], 16); best < 0 || sse < best {
+			best, mb.lumaMode, pred = sse, mode, p
+		}
+	}
+	cx0, cy0 := mbx*8, mby*8
+	best = -1
+	for mode := 0; mode < vp8NumPredModes; mode++ {
+		var p [2][64]uint8
+		vp8Predict(p[0][:], &e.recon[1], cx0, cy0, 8, mode)
+		vp8Predict(p[1][:], &e.recon[2], cx0, cy0, 8, mode)
+		sse := vp8SSE(&e.src[1], cx0, cy0, p[0][:], 8) + vp8SSE(&e.src[2], cx0, cy0, p[1][:], 8)
+		if best < 0 || sse < best {
+			best, mb.chromaMode, cpred = sse, mode, p
+		}
+	}
+
+	// Luma: 16 4x4 DCTs whose DC terms go through the WHT.
+	var coeffs [16][16]int32
+	var dcs [16]int32
+	for n := 0; n < 16; n++ {
+		bx, by := (n%4)*4, (n/4)*4
+		var res [16]int32
+		for j := 0; j < 4; j++ {
+			for i := 0; i < 4; i++ {
+				s := int32(e.src[0].pix[(y0+by+j)*e.src[0].stride+x0+bx+i])
+				res[4*j+i] = s - int32(pred[(by+j)*16+bx+i])
+			}
+		}
+		coeffs[n] = vp8ForwardDCT(&res)
+		dcs[n] = coeffs[n][0]
+	}
+	wht := vp8ForwardWHT(&dcs)
+	mb.y2 = vp8QuantizeBlock(&wht, e.quant.y2, 0)
+	dequantDC := vp8InverseWHT(&wht)
+	nonZero := false
+	for _, l := range mb.y2 {
+		nonZero = nonZero || l != 0
+	}
+
+	recon := &e.recon[0]
+	for j := 0; j < 16; j++ {
+		copy(recon.pix[(y0+j)*recon.stride+x0:], pred[j*16:j*16+16])
+	}
+	for n := 0; n < 16; n++ {
+		mb.y[n] = vp8QuantizeBlock(&coeffs[n], e.quant.y1, 1)
+		for _, l := range mb.y[n][1:] {
+			nonZero = nonZero || l != 0
+		}
+		coeffs[n][0] = dequantDC[n]
+		bx, by := (n%4)*4, (n/4)*4
+		vp8InverseDCT(&coeffs[n], recon.pix[(y0+by)*recon.stride+x0+bx:], recon.stride)
+	}
+
+	// Chroma: 4 4x4 DCTs per plane, no second-order transform.
+	for c := 0; c < 2; c++ {
+		src, recon := &e.src[1+c], &e.recon[1+c]
+		levels := &mb.u
+		if c == 1 {
+			levels = &mb.v
+		}
+		for j := 0; j < 8; j++ {
+			copy(recon.pix[(cy0+j)*recon.stride+cx0:], cpred[c][j*8:j*8+8])
+		}
+		for n := 0; n < 4; n++ {
+			bx, by := (n%2)*4, (n/2)*4
+			var res [16]int32
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					s := int32(src.pix[(cy0+by+j)*src.stride+cx0+bx+i])
+					res[4*j+i] = s - int32(cpred[c][(by+j)*8+bx+i])
+				}
+			}
+			coeff := vp8ForwardDCT(&res)
+			levels[n] = vp8QuantizeBlock(&coeff, e.quant.uv, 0)
+			for _, l := range levels[n] {
+				nonZero = nonZero || l != 0
+			}
+			vp8InverseDCT(&coeff, recon.pix[(cy0+by)*recon.stride+cx0+bx:], recon.stride)
+		}
+	}
+	mb.skip = !nonZero
+}
+
+// writeHeaders writes the first partition: the frame header followed by the
+// per-macroblock prediction modes.
+func (e *vp8Encoder) writeHeaders(mbs []vp8Macroblock, nParts int) []byte {
+	fp := newVP8BoolEncoder()
+	// Colour space and clamping type.
+	fp.writeBool(128, false)
+	fp.writeBool(128, false)
+	// No segmentation.
+	fp.writeBool(128, false)
+	// Normal loop filter with a level that grows with the quantizer.
+	fp.writeBool(128, false)
+	fp.writeLiteral(uint32(e.filterLevel()), 6)
+	fp.writeLiteral(0, 3)
+	fp.writeBool(128, false)
+	// Token partitions.
+	log2Parts := 0
+	for 1<<uint(log2Parts) < nParts {
+		log2Parts++
+	}
+	fp.writeLiteral(uint32(log2Parts), 2)
+	// Quantizer index with no per-coefficient-type deltas.
+	fp.writeLiteral(uint32(e.qIndex), 7)
+	for i := 0; i < 5; i++ {
+		fp.writeOptionalSigned(0, 4)
+	}
+	// refresh_entropy_probs.
+	fp.writeBool(128, false)
+	// Keep the default token probabilities.
+	for i := range vp8TokenUpdateProb {
+		for j := range vp8TokenUpdateProb[i] {
+			for k := range vp8TokenUpdateProb[i][j] {
+				for _, p := range vp8TokenUpdateProb[i][j][k] {
+					fp.writeBool(p, false)
+				}
+			}
+		}
+	}
+
+	skipped := 0
+	for i := range mbs {
+		if mbs[i].skip {
+			skipped++
+		}
+	}
+	skipProb := clampByte((len(mbs) - skipped) * 256 / len(mbs))
+	if skipProb == 0 {
+		skipProb = 1
+	}
+	fp.writeBool(128, true)
+	fp.writeLiteral(uint32(skipProb), 8)
+
+	for i := range mbs {
+		mb := &mbs[i]
+		fp.writeBool(skipProb, mb.skip)
+		// 16x16 luma prediction.
+		fp.writeBool(145, true)
+		switch mb.lumaMode {
+		case vp8PredDC:
+			fp.writeBool(156, false)
+			fp.writeBool(163, false)
+		case vp8PredVE:
+			fp.writeBool(156, false)
+			fp.writeBool(163, true)
+		case vp8PredHE:
+			fp.writeBool(156, true)
+			fp.writeBool(128, false)
+		case vp8PredTM:
+			fp.writeBool(156, true)
+			fp.writeBool(128, true)
+		}
+		switch mb.chromaMode {
+		case vp8PredDC:
+			fp.writeBool(142, false)
+		case vp8PredVE:
+			fp.writeBool(142, true)
+			fp.writeBool(114, false)
+		case vp8PredHE:
+			fp.writeBool(142, true)
+			fp.writeBool(114, true)
+			fp.writeBool(183, false)
+		case vp8PredTM:
+			fp.writeBool(142, true)
+			fp.writeBool(114, true)
+			fp.writeBool(183, true)
+		}
+	}
+	return fp.bytes()
+}
+
+func (e *vp8Encoder) filterLevel() int {
+	level := (e.qIndex*5 + 8) / 16
+	if level > 63 {
+		level = 63
+	}
+	return level
+}
+
+// writeTokens writes the residual coefficients of every macroblock that is
+// not skipped, tracking the same non-zero contexts as the decoder.
+func (e *vp8Encoder) writeTokens(mbs []vp8Macroblock, parts []*vp8BoolEncoder) {
+	upY2 := make([]uint8, e.mbw)
+	upY := make([][4]uint8, e.mbw)
+	upUV := make([][4]uint8, e.mbw)
+	for mby := 0; mby < e.mbh; mby++ {
+		part := parts[mby&(len(parts)-1)]
+		var leftY2 uint8
+		var leftY, leftUV [4]uint8
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &mbs[mby*e.mbw+mbx]
+			if mb.skip {
+				leftY2, upY2[mbx] = 0, 0
+				leftY, upY[mbx] = [4]uint8{}, [4]uint8{}
+				leftUV, upUV[mbx] = [4]uint8{}, [4]uint8{}
+				continue
+			}
+			nz := vp8WriteCoefficients(part, vp8PlaneY2, leftY2+upY2[mbx], &mb.y2, 0)
+			leftY2, upY2[mbx] = nz, nz
+			for y := 0; y < 4; y++ {
+				for x := 0; x < 4; x++ {
+					nz := vp8WriteCoefficients(part, vp8PlaneY1WithY2, leftY[y]+upY[mbx][x], &mb.y[4*y+x], 1)
+					leftY[y], upY[mbx][x] = nz, nz
+				}
+			}
+			for c, levels := range [2]*[4][16]int32{&mb.u, &mb.v} {
+				for y := 0; y < 2; y++ {
+					for x := 0; x < 2; x++ {
+						ctx := leftUV[2*c+y] + upUV[mbx][2*c+x]
+						nz := vp8WriteCoefficients(part, vp8PlaneUV, ctx, &levels[2*y+x], 0)
+						leftUV[2*c+y], upUV[mbx][2*c+x] = nz, nz
+					}
+				}
+			}
+		}
+	}
+}
+
+// vp8WriteCoefficients codes one block's levels (in raster order) as tokens
+// and returns 1 if any level was non-zero.
+func vp8WriteCoefficients(e *vp8BoolEncoder, plane int, ctx uint8, levels *[16]int32, first int) uint8 {
+	last := -1
+	for n := first; n < 16; n++ {
+		if levels[vp8Zigzag[n]] != 0 {
+			last = n
+		}
+	}
+	prob := &vp8DefaultTokenProb[plane]
+	p := prob[vp8Bands[first]][ctx]
+	if last < 0 {
+		e.writeBool(p[0], false)
+		return 0
+	}
+	e.writeBool(p[0], true)
+	for n := first; n < 16; {
+		v := levels[vp8Zigzag[n]]
+		n++
+		if v == 0 {
+			e.writeBool(p[1], false)
+			p = prob[vp8Bands[n]][0]
+			continue
+		}
+		e.writeBool(p[1], true)
+		neg := v < 0
+		if neg {
+			v = -v
+		}
+		if v == 1 {
+			e.writeBool(p[2], false)
+			p = prob[vp8Bands[n]][1]
+		} else {
+			e.writeBool(p[2], true)
+			vp8WriteLargeValue(e, p, v)
+			p = prob[vp8Bands[n]][2]
+		}
+		e.writeBool(128, neg)
+		if n == 16 {
+			break
+		}
+		e.writeBool(p[0], n <= last)
+		if n > last {
+			break
+		}
+	}
+	return 1
+}
+
+// vp8WriteLargeValue writes a level of 2 or more using the token tree and the
+// extra bits of the DCT_CAT categories.
+func vp8WriteLargeValue(e *vp8BoolEncoder, p [11]uint8, v int32) {
+	switch {
+	case v <= 4:
+		e.writeBool(p[3], false)
+		if v == 2 {
+			e.writeBool(p[4], false)
+		} else {
+			e.writeBool(p[4], true)
+			e.writeBool(p[5], v == 4)
+		}
+	case v <= 10:
+		e.writeBool(p[3], true)
+		e.writeBool(p[6], false)
+		if v <= 6 {
+			e.writeBool(p[7], false)
+			e.writeBool(159, v == 6)
+		} else {
+			e.writeBool(p[7], true)
+			b := v - 7
+			e.writeBool(165, b&2 != 0)
+			e.writeBool(145, b&1 != 0)
+		}
+	default:
+		e.writeBool(p[3], true)
+		e.writeBool(p[6], true)
+		cat := 3
+		switch {
+		case v < 19:
+			cat = 0
+		case v < 35:
+			cat = 1
+		case v < 67:
+			cat = 2
+		}
+		e.writeBool(p[8], cat >= 2)
+		e.writeBool(p[9+cat/2], cat&1 != 0)
+		extra := v - (3 + 8<<uint(cat))
+		tab := vp8CatProbs[cat]
+		n := 0
+		for tab[n] != 0 {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			e.writeBool(tab[i], extra>>uint(n-1-i)&1 != 0)
+		}
+	}
+}
+
+var (
+	// vp8Bands maps a coefficient position to its probability band.
+	vp8Bands = [17]uint8{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7, 0}
+	// vp8Zigzag is the coefficient scan order.
+	vp8Zigzag = [16]uint8{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+	// vp8CatProbs are the extra-bit probabilities of DCT_CAT3 to DCT_CAT6.
+	vp8CatProbs = [4][12]uint8{
+		{173, 148, 140, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		{176, 155, 140, 135, 0, 0, 0, 0, 0, 0, 0, 0},
+		{180, 157, 141, 134, 130, 0, 0, 0, 0, 0, 0, 0},
+		{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129, 0},
+	}
+)
+
+// Quantizer step tables, RFC 6386 section 14.1.
+var (
+	vp8DCTable = [128]uint16{
+		4, 5, 6, 7, 8, 9, 10, 10, 11, 12, 13, 14, 15, 16, 17, 17,
+		18, 19, 20, 20, 21, 21, 22, 22, 23, 23, 24, 25, 25, 26, 27, 28,
+		29, 30, 31, 32, 33, 34, 35, 36, 37, 37, 38, 39, 40, 41, 42, 43,
+		44, 45, 46, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58,
+		59, 60, 61, 62, 63, 64, 65, 66, 67, 68, 69, 70, 71, 72, 73, 74,
+		75, 76, 76, 77, 78, 79, 80, 81, 82, 83, 84, 85, 86, 87, 88, 89,
+		91, 93, 95, 96, 98, 100, 101, 102, 104, 106, 108, 110, 112, 114, 116, 118,
+		122, 124, 126, 128, 130, 132, 134, 136, 138, 140, 143, 145, 148, 151, 154, 157,
+	}
+	vp8ACTable = [128]uint16{
+		4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+		20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35,
+		36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
+		52, 53, 54, 55, 56, 57, 58, 60, 62, 64, 66, 68, 70, 72, 74, 76,
+		78, 80, 82, 84, 86, 88, 90, 92, 94, 96, 98, 100, 102, 104, 106, 108,
+		110, 112, 114, 116, 119, 122, 125, 128, 131, 134, 137, 140, 143, 146, 149, 152,
+		155, 158, 161, 164, 167, 170, 173, 177, 181, 185, 189, 193, 197, 201, 205, 209,
+		213, 217, 221, 225, 229, 234, 239, 245, 249, 254, 259, 264, 269, 274, 279, 284,
+	}
+)
+
+// Token probability update probabilities, RFC 6386 section 13.4.
+var vp8TokenUpdateProb = [4][8][3][11]uint8{
+	{
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{176, 246, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{223, 241, 252, 255, 255, 255, 255, 255, 255, 255, 255},
+			{249, 253, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 244, 252, 255, 255, 255, 255, 255, 255, 255, 255},
+			{234, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 246, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{239, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 248, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{251, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{251, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 253, 255, 254, 255, 255, 255, 255, 255, 255},
+			{250, 255, 254, 255, 254, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+	{
+		{
+			{217, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{225, 252, 241, 253, 255, 255, 254, 255, 255, 255, 255},
+			{234, 250, 241, 250, 253, 255, 253, 254, 255, 255, 255},
+		},
+		{
+			{255, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{223, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{238, 253, 254, 254, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 248, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{249, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{247, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{252, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{250, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+	{
+		{
+			{186, 251, 250, 255, 255, 255, 255, 255, 255, 255, 255},
+			{234, 251, 244, 254, 255, 255, 255, 255, 255, 255, 255},
+			{251, 251, 243, 253, 254, 255, 254, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{236, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{251, 253, 253, 254, 254, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 254, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+	{
+		{
+			{248, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{250, 254, 252, 254, 255, 255, 255, 255, 255, 255, 255},
+			{248, 254, 249, 253, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 253, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{246, 253, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{252, 254, 251, 254, 254, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 254, 252, 255, 255, 255, 255, 255, 255, 255, 255},
+			{248, 254, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 255, 254, 254, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 251, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{245, 251, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{253, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 251, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{252, 253, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 254, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 252, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{249, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 254, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 253, 255, 255, 255, 255, 255, 255, 255, 255},
+			{250, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{254, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+			{255, 255, 255, 255, 255, 255, 255, 255, 255, 255, 255},
+		},
+	},
+}
+
+// Default token probabilities, RFC 6386 section 13.5.
+var vp8DefaultTokenProb = [4][8][3][11]uint8{
+	{
+		{
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{253, 136, 254, 255, 228, 219, 128, 128, 128, 128, 128},
+			{189, 129, 242, 255, 227, 213, 255, 219, 128, 128, 128},
+			{106, 126, 227, 252, 214, 209, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 98, 248, 255, 236, 226, 255, 255, 128, 128, 128},
+			{181, 133, 238, 254, 221, 234, 255, 154, 128, 128, 128},
+			{78, 134, 202, 247, 198, 180, 255, 219, 128, 128, 128},
+		},
+		{
+			{1, 185, 249, 255, 243, 255, 128, 128, 128, 128, 128},
+			{184, 150, 247, 255, 236, 224, 128, 128, 128, 128, 128},
+			{77, 110, 216, 255, 236, 230, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 101, 251, 255, 241, 255, 128, 128, 128, 128, 128},
+			{170, 139, 241, 252, 236, 209, 255, 255, 128, 128, 128},
+			{37, 116, 196, 243, 228, 255, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 204, 254, 255, 245, 255, 128, 128, 128, 128, 128},
+			{207, 160, 250, 255, 238, 128, 128, 128, 128, 128, 128},
+			{102, 103, 231, 255, 211, 171, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 152, 252, 255, 240, 255, 128, 128, 128, 128, 128},
+			{177, 135, 243, 255, 234, 225, 128, 128, 128, 128, 128},
+			{80, 129, 211, 255, 194, 224, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{246, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{255, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+	},
+	{
+		{
+			{198, 35, 237, 223, 193, 187, 162, 160, 145, 155, 62},
+			{131, 45, 198, 221, 172, 176, 220, 157, 252, 221, 1},
+			{68, 47, 146, 208, 149, 167, 221, 162, 255, 223, 128},
+		},
+		{
+			{1, 149, 241, 255, 221, 224, 255, 255, 128, 128, 128},
+			{184, 141, 234, 253, 222, 220, 255, 199, 128, 128, 128},
+			{81, 99, 181, 242, 176, 190, 249, 202, 255, 255, 128},
+		},
+		{
+			{1, 129, 232, 253, 214, 197, 242, 196, 255, 255, 128},
+			{99, 121, 210, 250, 201, 198, 255, 202, 128, 128, 128},
+			{23, 91, 163, 242, 170, 187, 247, 210, 255, 255, 128},
+		},
+		{
+			{1, 200, 246, 255, 234, 255, 128, 128, 128, 128, 128},
+			{109, 178, 241, 255, 231, 245, 255, 255, 128, 128, 128},
+			{44, 130, 201, 253, 205, 192, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 132, 239, 251, 219, 209, 255, 165, 128, 128, 128},
+			{94, 136, 225, 251, 218, 190, 255, 255, 128, 128, 128},
+			{22, 100, 174, 245, 186, 161, 255, 199, 128, 128, 128},
+		},
+		{
+			{1, 182, 249, 255, 232, 235, 128, 128, 128, 128, 128},
+			{124, 143, 241, 255, 227, 234, 128, 128, 128, 128, 128},
+			{35, 77, 181, 251, 193, 211, 255, 205, 128, 128, 128},
+		},
+		{
+			{1, 157, 247, 255, 236, 231, 255, 255, 128, 128, 128},
+			{121, 141, 235, 255, 225, 227, 255, 255, 128, 128, 128},
+			{45, 99, 188, 251, 195, 217, 255, 224, 128, 128, 128},
+		},
+		{
+			{1, 1, 251, 255, 213, 255, 128, 128, 128, 128, 128},
+			{203, 1, 248, 255, 255, 128, 128, 128, 128, 128, 128},
+			{137, 1, 177, 255, 224, 255, 128, 128, 128, 128, 128},
+		},
+	},
+	{
+		{
+			{253, 9, 248, 251, 207, 208, 255, 192, 128, 128, 128},
+			{175, 13, 224, 243, 193, 185, 249, 198, 255, 255, 128},
+			{73, 17, 171, 221, 161, 179, 236, 167, 255, 234, 128},
+		},
+		{
+			{1, 95, 247, 253, 212, 183, 255, 255, 128, 128, 128},
+			{239, 90, 244, 250, 211, 209, 255, 255, 128, 128, 128},
+			{155, 77, 195, 248, 188, 195, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 24, 239, 251, 218, 219, 255, 205, 128, 128, 128},
+			{201, 51, 219, 255, 196, 186, 128, 128, 128, 128, 128},
+			{69, 46, 190, 239, 201, 218, 255, 228, 128, 128, 128},
+		},
+		{
+			{1, 191, 251, 255, 255, 128, 128, 128, 128, 128, 128},
+			{223, 165, 249, 255, 213, 255, 128, 128, 128, 128, 128},
+			{141, 124, 248, 255, 255, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 16, 248, 255, 255, 128, 128, 128, 128, 128, 128},
+			{190, 36, 230, 255, 236, 255, 128, 128, 128, 128, 128},
+			{149, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 226, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{247, 192, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{240, 128, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{1, 134, 252, 255, 255, 128, 128, 128, 128, 128, 128},
+			{213, 62, 250, 255, 255, 128, 128, 128, 128, 128, 128},
+			{55, 93, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+		{
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+			{128, 128, 128, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+	},
+	{
+		{
+			{202, 24, 213, 235, 186, 191, 220, 160, 240, 175, 255},
+			{126, 38, 182, 232, 169, 184, 228, 174, 255, 187, 128},
+			{61, 46, 138, 219, 151, 178, 240, 170, 255, 216, 128},
+		},
+		{
+			{1, 112, 230, 250, 199, 191, 247, 159, 255, 255, 128},
+			{166, 109, 228, 252, 211, 215, 255, 174, 128, 128, 128},
+			{39, 77, 162, 232, 172, 180, 245, 178, 255, 255, 128},
+		},
+		{
+			{1, 52, 220, 246, 198, 199, 249, 220, 255, 255, 128},
+			{124, 74, 191, 243, 183, 193, 250, 221, 255, 255, 128},
+			{24, 71, 130, 219, 154, 170, 243, 182, 255, 255, 128},
+		},
+		{
+			{1, 182, 225, 249, 219, 240, 255, 224, 128, 128, 128},
+			{149, 150, 226, 252, 216, 205, 255, 171, 128, 128, 128},
+			{28, 108, 170, 242, 183, 194, 254, 223, 255, 255, 128},
+		},
+		{
+			{1, 81, 230, 252, 204, 203, 255, 192, 128, 128, 128},
+			{123, 102, 209, 247, 188, 196, 255, 233, 128, 128, 128},
+			{20, 95, 153, 243, 164, 173, 255, 203, 128, 128, 128},
+		},
+		{
+			{1, 222, 248, 255, 216, 213, 128, 128, 128, 128, 128},
+			{168, 175, 246, 252, 235, 205, 255, 255, 128, 128, 128},
+			{47, 116, 215, 255, 211, 212, 255, 255, 128, 128, 128},
+		},
+		{
+			{1, 121, 236, 253, 212, 214, 255, 255, 128, 128, 128},
+			{141, 84, 213, 252, 201, 202, 255, 219, 128, 128, 128},
+			{42, 80, 160, 240, 162, 185, 255, 205, 128, 128, 128},
+		},
+		{
+			{1, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{244, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+			{238, 1, 255, 128, 128, 128, 128, 128, 128, 128, 128},
+		},
+	},
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// webpTestSizes covers single pixels, sizes that aren't a multiple of the
+// 16x16 macroblock, and images spanning several macroblocks.
+var webpTestSizes = []struct{ w, h int }{
+	{1, 1}, {1, 7}, {7, 1}, {3, 5}, {17, 31}, {64, 48}, {257, 129},
+}
+
+// webpNoise returns a w x h image filled with noise. Opaque images have
+// every alpha at 255.
+func webpNoise(w, h int, opaque bool) *image.NRGBA {
+	r := rand.New(rand.NewSource(int64(w*h + w)))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	r.Read(img.Pix)
+	if opaque {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img
+}
+
+// webpSmooth returns a w x h image of slow waves, the kind of content
+// lossy compression is meant for, with a soft alpha ramp unless opaque. The
+// slope doesn't depend on the size, so small images are no harder.
+func webpSmooth(w, h int, opaque bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			fx, fy := float64(x), float64(y)
+			c := color.NRGBA{
+				R: uint8(128 + 100*math.Sin(fx/9)),
+				G: uint8(128 + 100*math.Cos(fy/7)),
+				B: uint8(128 + 80*math.Sin((fx+fy)/13)),
+				A: 0xff,
+			}
+			if !opaque {
+				c.A = uint8(255 - (x+y)%200)
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodeWebPForTest(t *testing.T, img image.Image, opts *webpOptions) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encodeWebP(&buf, img, opts); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	cfg, err := webp.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	if b := img.Bounds(); cfg.Width != b.Dx() || cfg.Height != b.Dy() {
+		t.Fatalf("config says %dx%d, want %dx%d", cfg.Width, cfg.Height, b.Dx(), b.Dy())
+	}
+	return buf.Bytes()
+}
+
+func TestWebPLosslessRoundTrip(t *testing.T) {
+	for _, size := range webpTestSizes {
+		for _, opaque := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%dx%d/opaque=%v", size.w, size.h, opaque), func(t *testing.T) {
+				src := webpNoise(size.w, size.h, opaque)
+				data := encodeWebPForTest(t, src, &webpOptions{Lossless: true})
+				got, err := webp.Decode(bytes.NewReader(data))
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				for y := 0; y < size.h; y++ {
+					for x := 0; x < size.w; x++ {
+						want := src.NRGBAAt(x, y)
+						if have := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA); have != want {
+							t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, have, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWebPLosslessPalette(t *testing.T) {
+	// Few colours take the palette path
+	src := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	colors := []color.NRGBA{{255, 0, 0, 255}, {0, 128, 255, 255}, {10, 20, 30, 0}, {200, 200, 200, 128}}
+	for y := 0; y < 23; y++ {
+		for x := 0; x < 37; x++ {
+			src.SetNRGBA(x, y, colors[(x*y+x)%len(colors)])
+		}
+	}
+	got, err := webp.Decode(bytes.NewReader(encodeWebPForTest(t, src, &webpOptions{Lossless: true})))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	for y := 0; y < 23; y++ {
+		for x := 0; x < 37; x++ {
+			if have, want := color.NRGBAModel.Convert(got.At(x, y)), src.NRGBAAt(x, y); have != want {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, have, want)
+			}
+		}
+	}
+}
+
+func TestWebPLossyRoundTrip(t *testing.T) {
+	// Per-channel error bounds on webpSmooth, a little above what the
+	// encoder gives today; chroma subsampling alone accounts for much of it
+	bounds := []struct {
+		quality  int
+		maxError int
+		maxMean  float64
+	}{
+		{75, 48, 10},
+		{95, 28, 4.5},
+	}
+
+	for _, bound := range bounds {
+		for _, size := range webpTestSizes {
+			for _, opaque := range []bool{true, false} {
+				name := fmt.Sprintf("q%d/%dx%d/opaque=%v", bound.quality, size.w, size.h, opaque)
+				t.Run(name, func(t *testing.T) {
+					src := webpSmooth(size.w, size.h, opaque)
+					data := encodeWebPForTest(t, src, &webpOptions{Quality: bound.quality})
+					// decodeWebP converts the Y'CbCr that x/image/webp
+					// returns with VP8's own coefficients
+					got, err := decodeWebP(bytes.NewReader(data))
+					if err != nil {
+						t.Fatalf("decode: %v", err)
+					}
+
+					worst, total := 0, 0
+					for y := 0; y < size.h; y++ {
+						for x := 0; x < size.w; x++ {
+							want := src.NRGBAAt(x, y)
+							have := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA)
+							// Alpha is stored losslessly
+							if have.A != want.A {
+								t.Fatalf("alpha at (%d, %d) = %d, want %d", x, y, have.A, want.A)
+							}
+							for _, d := range []int{
+								absInt(int(have.R) - int(want.R)),
+								absInt(int(have.G) - int(want.G)),
+								absInt(int(have.B) - int(want.B)),
+							} {
+								worst = max(worst, d)
+								total += d
+							}
+						}
+					}
+					mean := float64(total) / float64(3*size.w*size.h)
+					if worst > bound.maxError || mean > bound.maxMean {
+						t.Errorf("max error %d, mean %.2f; want at most %d and %.1f", worst, mean, bound.maxError, bound.maxMean)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestWebPLossyQualityOrdersSize(t *testing.T) {
+	src := webpSmooth(96, 64, true)
+	low := encodeWebPForTest(t, src, &webpOptions{Quality: 20})
+	high := encodeWebPForTest(t, src, &webpOptions{Quality: 95})
+	if len(low) >= len(high) {
+		t.Errorf("quality 20 gave %d bytes, quality 95 %d; want fewer at the lower quality", len(low), len(high))
+	}
+}
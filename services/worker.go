@@ -0,0 +1,145 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// WorkerArg, as the first command line argument, starts the binary as a
+// processing worker instead of the app. See RunWorker.
+const WorkerArg = "--image-worker"
+
+// workerStderrLimit is how much of a worker's stderr is kept for the task's
+// stack trace when the worker dies.
+const workerStderrLimit = 32 << 10
+
+// workerResponse is what a worker writes back for its job.
+type workerResponse struct {
+	Result *taskResult `json:"result"`
+	Error  string      `json:"error"`
+	Stack  string      `json:"stack"` // set when the job panicked
+	Limit  bool        `json:"limit"` // the error is a resource limit
+	// Transient marks an error that may go away on a retry
+	Transient bool `json:"transient"`
+}
+
+// workerError is an error reported by a worker process, keeping the parts
+// of its identity that callers check for.
+type workerError struct {
+	message   string
+	cause     error
+	transient bool
+}
+
+func (e *workerError) Error() string {
+	return e.message
+}
+
+// Transient reports whether the error was transient in the worker, for
+// isTransient.
+func (e *workerError) Transient() bool {
+	return e.transient
+}
+
+func (e *workerError) Unwrap() error {
+	return e.cause
+}
+
+// RunWorker runs one job read as JSON from stdin and writes the response as
+// JSON to stdout. Anything else the job prints goes to stderr, so it can't
+// corrupt the response.
+func RunWorker() error {
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	log.SetPrefix("worker: ")
+
+	var job taskJob
+	if err := json.NewDecoder(os.Stdin).Decode(&job); err != nil {
+		return fmt.Errorf("failed to read worker job: %w", err)
+	}
+
+	result, err := runJobSafely(context.Background(), &job)
+	response := workerResponse{Result: result}
+	if err != nil {
+		response.Error = err.Error()
+		response.Limit = errors.Is(err, errLimitExceeded)
+		response.Transient = isTransient(err)
+		var crash *crashError
+		if errors.As(err, &crash) {
+			response.Stack = crash.Stack
+		}
+	}
+	if err := json.NewEncoder(out).Encode(&response); err != nil {
+		return fmt.Errorf("failed to write worker response: %w", err)
+	}
+	return nil
+}
+
+// runJobInWorker runs job in a new process started from this executable.
+// A crash there, even one Go can't recover from such as running out of
+// memory, fails only the task. Cancelling ctx kills the worker.
+func runJobInWorker(ctx context.Context, job *taskJob) (*taskResult, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find worker executable: %w", err)
+	}
+	input, err := json.Marshal(job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode worker job: %w", err)
+	}
+
+	var stdout bytes.Buffer
+	stderr := &tailBuffer{limit: workerStderrLimit}
+	cmd := exec.CommandContext(ctx, exe, WorkerArg)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	runErr := cmd.Run()
+
+	var response workerResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		// The worker died before answering
+		if runErr == nil {
+			runErr = err
+		}
+		return nil, &crashError{
+			Message: fmt.Sprintf("worker process crashed: %v", runErr),
+			Stack:   stderr.String(),
+		}
+	}
+
+	switch {
+	case response.Stack != "":
+		return response.Result, &crashError{Message: response.Error, Stack: response.Stack}
+	case response.Limit:
+		return response.Result, &workerError{message: response.Error, cause: errLimitExceeded}
+	case response.Error != "":
+		return response.Result, &workerError{message: response.Error, transient: response.Transient}
+	}
+	return response.Result, nil
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.limit; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}